@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/yzzyx/microci/job"
+)
+
+// apiArtifact describes a single artifact produced by a job
+type apiArtifact struct {
+	Name   string `json:"name"` // Path relative to the artifact folder
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	URL    string `json:"url"`
+}
+
+// apiJob is the JSON representation of a job
+type apiJob struct {
+	ID          string        `json:"id"`
+	URL         string        `json:"url"`
+	Status      string        `json:"status"`
+	Description string        `json:"description"`
+	Type        string        `json:"type"`
+	Repository  string        `json:"repository"`
+	Queue       string        `json:"queue"`
+	Context     string        `json:"context"`
+	Commit      string        `json:"commit"`
+	Script      string        `json:"script"`
+	RerunOf     string        `json:"rerun_of,omitempty"`
+	Reruns      []string      `json:"reruns,omitempty"`
+	Created     time.Time     `json:"created"`
+	Started     *time.Time    `json:"started,omitempty"`
+	Finished    *time.Time    `json:"finished,omitempty"`
+	Duration    float64       `json:"duration"`
+	Sections    []apiSection  `json:"sections,omitempty"`
+	Artifacts   []apiArtifact `json:"artifacts"`
+}
+
+// apiSection describes the timing of a single section of a job
+type apiSection struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration"`
+}
+
+// apiQueue is the JSON representation of a repository queue
+type apiQueue struct {
+	Name    string   `json:"name"`
+	Context string   `json:"context"`
+	LastJob *apiJob  `json:"last_job,omitempty"`
+	Jobs    []apiJob `json:"jobs,omitempty"`
+}
+
+// apiRepository is the JSON representation of a repository
+type apiRepository struct {
+	Name   string     `json:"name"`
+	Queues []apiQueue `json:"queues"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (v *View) apiJob(j *job.Job, withArtifacts bool) apiJob {
+	a := apiJob{
+		ID:          j.ID,
+		URL:         j.TargetURL,
+		Status:      j.Status.String(),
+		Description: j.StatusDescription,
+		Type:        j.Type.String(),
+		Repository:  j.CommitRepo,
+		Queue:       j.QueueName,
+		Context:     j.Context,
+		Commit:      j.CommitID,
+		Script:      strings.TrimPrefix(strings.TrimPrefix(j.Script, v.cfg.Scripts.Folder), "/"),
+		RerunOf:     j.RerunOf,
+		Reruns:      j.Reruns,
+		Created:     j.Created,
+		Duration:    j.Duration().Seconds(),
+		Artifacts:   []apiArtifact{},
+	}
+
+	if !j.Started.IsZero() {
+		started := j.Started
+		a.Started = &started
+	}
+
+	if !j.Finished.IsZero() {
+		finished := j.Finished
+		a.Finished = &finished
+	}
+
+	for _, s := range j.Sections {
+		a.Sections = append(a.Sections, apiSection{Name: s.Name, Duration: s.Duration().Seconds()})
+	}
+
+	if a.URL == "" {
+		a.URL = strings.TrimSuffix(v.cfg.Server.Address, "/") + path.Join("/job", j.ID)
+	}
+
+	if !withArtifacts {
+		return a
+	}
+
+	for _, artifact := range j.ListArtifacts() {
+		a.Artifacts = append(a.Artifacts, apiArtifact{
+			Name:   artifact.Path,
+			Size:   artifact.Size,
+			SHA256: artifact.SHA256,
+			URL:    a.URL + "/artifacts/" + artifact.EscapedPath(),
+		})
+	}
+	return a
+}
+
+func (v *View) apiRepository(repo *Repository, withJobs bool) apiRepository {
+	a := apiRepository{
+		Name:   repo.Name,
+		Queues: []apiQueue{},
+	}
+
+	for _, q := range repo.GetQueues() {
+		aq := apiQueue{
+			Name:    q.Name,
+			Context: q.Context,
+		}
+
+		if j := q.GetLastJob(); j != nil {
+			last := v.apiJob(j, false)
+			aq.LastJob = &last
+		}
+
+		if withJobs {
+			for _, j := range q.GetJobs() {
+				aq.Jobs = append(aq.Jobs, v.apiJob(j, false))
+			}
+		}
+		a.Queues = append(a.Queues, aq)
+	}
+	return a
+}
+
+// APIGetRepositories returns all known repositories and their queues
+func (v *View) APIGetRepositories(w http.ResponseWriter, r *http.Request) error {
+	repos := []apiRepository{}
+	for _, repo := range v.manager.GetRepos() {
+		repos = append(repos, v.apiRepository(repo, false))
+	}
+	return writeJSON(w, repos)
+}
+
+// APIGetRepository returns a single repository, including the jobs in each queue
+func (v *View) APIGetRepository(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "owner") + "/" + chi.URLParam(r, "name")
+
+	repo := v.manager.FindRepo(name)
+	if repo == nil {
+		return errNotFound
+	}
+	return writeJSON(w, v.apiRepository(repo, true))
+}
+
+// APIGetActiveJobs returns all pending and executing jobs
+func (v *View) APIGetActiveJobs(w http.ResponseWriter, r *http.Request) error {
+	jobs := []apiJob{}
+	for _, j := range v.manager.GetActiveJobs() {
+		jobs = append(jobs, v.apiJob(j, false))
+	}
+	return writeJSON(w, jobs)
+}
+
+// APIGetJob returns a specific job
+func (v *View) APIGetJob(w http.ResponseWriter, r *http.Request) error {
+	j, err := v.manager.GetJob(chi.URLParam(r, "id"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, v.apiJob(j, true))
+}
+
+// APICancelJob aborts a specific job, and returns its updated state
+func (v *View) APICancelJob(w http.ResponseWriter, r *http.Request) error {
+	j, err := v.manager.GetJob(chi.URLParam(r, "id"))
+	if err != nil {
+		return err
+	}
+
+	j.Cancel()
+	return writeJSON(w, v.apiJob(j, true))
+}
+
+// APIRerunJob creates a new job from an existing one, and returns the new job
+func (v *View) APIRerunJob(w http.ResponseWriter, r *http.Request) error {
+	prev, err := v.manager.GetJob(chi.URLParam(r, "id"))
+	if err != nil {
+		return err
+	}
+
+	j, err := v.manager.RerunJob(prev)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return writeJSON(w, v.apiJob(j, false))
+}
+
+// triggerErrorStatus returns the status code for an error returned by TriggerJob,
+// so that clients can tell invalid requests from failures that may succeed if retried
+func triggerErrorStatus(err error) int {
+	var invalid *invalidTriggerError
+	var giteaErr *giteaError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &giteaErr):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// APITriggerJob creates a job running a script for a branch or commit in a repository
+func (v *View) APITriggerJob(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Repository string `json:"repository"`
+		Ref        string `json:"ref"`
+		Commit     string `json:"commit"`
+		Script     string `json:"script"`
+		Context    string `json:"context"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return writeJSON(w, map[string]string{"error": err.Error()})
+	}
+
+	j, err := v.manager.TriggerJob(TriggerOptions{
+		Repository: req.Repository,
+		Ref:        req.Ref,
+		Commit:     req.Commit,
+		Script:     req.Script,
+		Context:    req.Context,
+	})
+	if err != nil {
+		w.WriteHeader(triggerErrorStatus(err))
+		return writeJSON(w, map[string]string{"error": err.Error()})
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return writeJSON(w, v.apiJob(j, false))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/yzzyx/microci/job"
+)
+
+// viewableTypes lists the content types of artifacts that are shown in the browser instead of being downloaded
+var viewableTypes = map[string]bool{
+	"text/plain":       true,
+	"text/html":        true,
+	"text/css":         true,
+	"text/csv":         true,
+	"text/xml":         true,
+	"application/json": true,
+	"application/xml":  true,
+	"application/pdf":  true,
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+}
+
+// isViewable returns true if artifacts with contentType can be shown in the browser
+func isViewable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && viewableTypes[mediaType]
+}
+
+// artifactPath returns the path and file information of the artifact name of job j.
+// Only folders and regular files within the artifact folder are artifacts. Paths that leave
+// the folder, or that contain symlinks, are reported as not found
+func artifactPath(j *job.Job, name string) (string, os.FileInfo, error) {
+	rel := filepath.Join("artifacts", filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+name), "/")))
+	resolved, err := filepath.EvalSymlinks(filepath.Join(j.Folder, rel))
+	if os.IsNotExist(err) {
+		return "", nil, errNotFound
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	// The jobs folder may be reached through a symlink, so the resolved path is compared with the resolved job folder.
+	// Any symlink within the job folder, including the artifact folder itself, makes the paths differ
+	root, err := filepath.EvalSymlinks(j.Folder)
+	if err != nil {
+		return "", nil, err
+	}
+	resolvedRel, err := filepath.Rel(root, resolved)
+	if err != nil || resolvedRel != rel {
+		return "", nil, errNotFound
+	}
+
+	st, err := os.Lstat(resolved)
+	if err != nil {
+		return "", nil, err
+	}
+	if !st.IsDir() && !st.Mode().IsRegular() {
+		return "", nil, errNotFound
+	}
+	return resolved, st, nil
+}
+
+// artifactContentType returns the content type of the artifact name, based on its extension,
+// or on its contents if the extension is unknown
+func artifactContentType(name string, f io.ReadSeeker) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// GetArtifactArchive returns all artifacts of a job in a single zip or tar.gz archive,
+// depending on the extension of the requested path
+func (v *View) GetArtifactArchive(w http.ResponseWriter, r *http.Request) error {
+	j, err := v.manager.GetJob(chi.URLParam(r, "id"))
+	if err != nil {
+		return err
+	}
+
+	format := "zip"
+	if strings.HasSuffix(r.URL.Path, ".tar.gz") {
+		format = "tar.gz"
+	}
+
+	folder := j.ArtifactFolder()
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"artifacts-%s.%s\"", j.ID[:12], format))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, folder)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGz(w, folder)
+	}
+
+	if err != nil {
+		// Part of the archive may already have been sent, so the error can't be reported with a status code.
+		// The connection is aborted instead, so that the client doesn't mistake it for a complete archive
+		log.Printf("Could not send artifacts of job %s: %v", j.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// writeZip writes all artifacts in folder to w as a zip archive
+func writeZip(w io.Writer, folder string) error {
+	zw := zip.NewWriter(w)
+	err := job.WalkArtifacts(folder, func(rel string, info os.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Method = zip.Deflate
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyArtifact(fw, filepath.Join(folder, filepath.FromSlash(rel)))
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes all artifacts in folder to w as a gzip compressed tar archive
+func writeTarGz(w io.Writer, folder string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := job.WalkArtifacts(folder, func(rel string, info os.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyArtifact(tw, filepath.Join(folder, filepath.FromSlash(rel)))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyArtifact writes the contents of the file p to w
+func copyArtifact(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
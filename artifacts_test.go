@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/yzzyx/microci/job"
+)
+
+// newArtifactTestJob creates a job folder with an artifact, and files outside the artifact folder
+// that must never be served. It returns the job and a folder outside the job folder
+func newArtifactTestJob(t *testing.T) (*job.Job, string) {
+	folder, err := ioutil.TempDir("", "microci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+
+	files := map[string]string{
+		"jobs/job/artifacts/dir/file.txt": "artifact",
+		"jobs/job/logs":                   "log",
+		"jobs/job/secrets/TOKEN":          "secret",
+		"outside/file.txt":                "outside",
+	}
+	for name, content := range files {
+		p := filepath.Join(folder, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j := &job.Job{ID: "job", Folder: filepath.Join(folder, "jobs", "job")}
+	return j, filepath.Join(folder, "outside")
+}
+
+// getArtifact requests the artifact at urlPath, relative to the artifacts of j, and returns the response
+func getArtifact(t *testing.T, j *job.Job, urlPath string) *httptest.ResponseRecorder {
+	manager := &Manager{jobs: map[string]*job.Job{j.ID: j}, jobsMutex: &sync.RWMutex{}}
+	view := &View{manager: manager}
+
+	router := chi.NewRouter()
+	router.Get("/job/{id}/artifacts/*", ViewWrapper(view.GetArtifact))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/job/"+j.ID+"/artifacts/"+urlPath, nil))
+	return w
+}
+
+func TestGetArtifact(t *testing.T) {
+	j, _ := newArtifactTestJob(t)
+
+	w := getArtifact(t, j, "dir/file.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "artifact" {
+		t.Errorf("got status %d and body %q, expected the artifact", w.Code, w.Body.String())
+	}
+}
+
+func TestGetArtifactOutsideFolder(t *testing.T) {
+	tests := []struct {
+		name    string
+		urlPath string
+		setup   func(j *job.Job, outside string) error
+	}{
+		{name: "parent folder", urlPath: "../logs"},
+		{name: "parent of nested folder", urlPath: "dir/../../secrets/TOKEN"},
+		{name: "absolute path", urlPath: "/etc/passwd"},
+		{name: "absolute path to job folder", urlPath: "/../logs"},
+		{name: "encoded parent folder", urlPath: "%2e%2e/logs"},
+		{name: "encoded separator", urlPath: "..%2flogs"},
+		{name: "encoded parent and separator", urlPath: "%2e%2e%2f%2e%2e%2fjob%2flogs"},
+		{name: "double encoded", urlPath: "%252e%252e%252flogs"},
+		{
+			name:    "symlink to file outside folder",
+			urlPath: "link.txt",
+			setup: func(j *job.Job, outside string) error {
+				return os.Symlink(filepath.Join(outside, "file.txt"), filepath.Join(j.ArtifactFolder(), "link.txt"))
+			},
+		},
+		{
+			name:    "symlink to job folder",
+			urlPath: "link/logs",
+			setup: func(j *job.Job, outside string) error {
+				return os.Symlink("..", filepath.Join(j.ArtifactFolder(), "link"))
+			},
+		},
+		{
+			name:    "symlink to folder outside",
+			urlPath: "link/file.txt",
+			setup: func(j *job.Job, outside string) error {
+				return os.Symlink(outside, filepath.Join(j.ArtifactFolder(), "link"))
+			},
+		},
+		{
+			name:    "artifact folder is a symlink",
+			urlPath: "file.txt",
+			setup: func(j *job.Job, outside string) error {
+				err := os.RemoveAll(j.ArtifactFolder())
+				if err != nil {
+					return err
+				}
+				return os.Symlink(outside, j.ArtifactFolder())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, outside := newArtifactTestJob(t)
+			if tt.setup != nil {
+				err := tt.setup(j, outside)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := getArtifact(t, j, tt.urlPath)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("got status %d, expected %d", w.Code, http.StatusNotFound)
+			}
+			for _, content := range []string{"log", "secret", "outside"} {
+				if strings.Contains(w.Body.String(), content) {
+					t.Errorf("response contains %q", content)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package config
 
 import "time"
 
+// File is the name of the configuration file, which is read from the current folder
+const File = "config.yaml"
+
 // Config includes all configuration variables
 type Config struct {
 	ResourceDir string `fig:"resource_dir"`
@@ -12,6 +15,13 @@ type Config struct {
 
 		// Address/interface to bind to (defaults to empty)
 		BindAddress string `fig:"bind_address" default:""`
+
+		// Credentials required to manually trigger jobs.
+		// If no username is set, manual triggering is disabled
+		Admin struct {
+			Username string `fig:"username"`
+			Password string `fig:"password"`
+		}
 	}
 
 	Scripts struct {
@@ -22,8 +32,66 @@ type Config struct {
 		Folder           string        `fig:"folder" default:"jobs"`
 		DefaultContext   string        `fig:"default_context"`
 		MaxExecutionTime time.Duration `fig:"max_execution_time" default:"10m"`
+		KillGracePeriod  time.Duration `fig:"kill_grace_period" default:"10s"`
 		CancelPrevious   bool          `fig:"cancel_previous"`
 		Workers          int           `fig:"workers" default:"1"`
+
+		// Maximum number of jobs waiting for a free worker (0 means unlimited),
+		// and what to do when a job is added to a full queue ("reject" or "drop_oldest")
+		QueueSize     int    `fig:"queue_size" default:"100"`
+		QueueOverflow string `fig:"queue_overflow" default:"reject"`
+
+		// Default settings for scripts, which can be overridden per repository and script
+		Defaults ScriptSettings `fig:"defaults"`
+
+		// cgroup v2 folder delegated to microci, used to apply memory, CPU and process limits
+		Cgroup string `fig:"cgroup"`
+
+		// Variables from the environment of microci that are passed to scripts, in addition to PATH, HOME and LANG
+		PassEnvironment []string `fig:"pass_environment"`
+
+		// Settings for CI configuration files (.microci.yml) committed in repositories
+		RepoConfig struct {
+			// If set, configuration in the repository is used instead of server-side scripts
+			Enabled bool `fig:"enabled"`
+			// If set, configuration is also read from pull requests from forked repositories
+			AllowForks bool `fig:"allow_forks"`
+		} `fig:"repo_config"`
+
+		// Retention policies for old jobs. A zero value disables the policy
+		Retention struct {
+			// How often old jobs should be removed
+			Interval time.Duration `fig:"interval" default:"1h"`
+			// Remove jobs older than this
+			MaxAge time.Duration `fig:"max_age"`
+			// Maximum number of finished jobs to keep in each queue (branch/pull-request and context),
+			// not counting jobs kept by KeepSuccessful
+			MaxPerQueue int `fig:"max_per_queue"`
+			// Remove the oldest jobs when the jobs folder uses more than this many megabytes
+			MaxDiskUsage int64 `fig:"max_disk_usage_mb"`
+			// Always keep the last N successful jobs in each queue
+			KeepSuccessful int `fig:"keep_successful"`
+			// Remove the git checkout of jobs older than this, but keep logs and artifacts
+			CheckoutMaxAge time.Duration `fig:"checkout_max_age"`
+			// Remove the artifacts of jobs older than this, but keep the rest of the job
+			ArtifactsMaxAge time.Duration `fig:"artifacts_max_age"`
+		}
+	}
+
+	// Data shared between jobs of the same repository
+	Cache struct {
+		// Folder containing a git mirror of each repository, and the caches declared in script settings
+		Folder string `fig:"folder" default:"cache"`
+		// How often new commits are fetched into the mirrors, and the mirrors are cleaned up
+		MirrorInterval time.Duration `fig:"mirror_interval" default:"6h"`
+		// Remove caches that have not been restored or saved by any job for this long. Zero keeps them forever
+		MaxAge time.Duration `fig:"max_age" default:"168h"`
+	}
+
+	// Secrets made available to jobs, stored encrypted in the scripts folder
+	Secrets struct {
+		// Base64 encoded key used to encrypt secrets, see 'microci secret generate-key'
+		Key string `fig:"key"`
 	}
 
 	// Gitea specific settings
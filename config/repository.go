@@ -0,0 +1,165 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/kkyr/fig"
+)
+
+// RepositoryFile is the name of the file containing repository specific settings,
+// located in the repository's folder in the scripts folder
+const RepositoryFile = "repo.yaml"
+
+// Schedule describes a job that should be executed periodically
+type Schedule struct {
+	// Name of schedule, jobs will be added to the queue "schedule:<name>"
+	Name string `fig:"name" validate:"required"`
+	// Cron expression describing when the job should run, e.g. "0 2 * * *"
+	Cron string `fig:"cron" validate:"required"`
+	// Branch to run the job on. Defaults to the default branch of the repository
+	Branch  string `fig:"branch"`
+	Script  string `fig:"script" default:"default.sh"`
+	Context string `fig:"context"`
+}
+
+// Context describes a script that should be executed for every webhook event,
+// with its result reported to gitea using the context name
+type Context struct {
+	Name   string `fig:"name" validate:"required"`
+	Script string `fig:"script" validate:"required"`
+}
+
+// Executor decides how scripts are executed
+type Executor struct {
+	// "host" executes scripts directly on the host, "container" executes them in a container,
+	// and "sandbox" executes them in separate linux namespaces
+	Type string `fig:"type"`
+	// Container image to use
+	Image string `fig:"image"`
+	// Container runtime to use, "docker" or "podman"
+	Runtime string `fig:"runtime"`
+	// Network used by the sandbox and container executors. "none" disables network access
+	Network string `fig:"network"`
+}
+
+// Limits restricts the resources available to a script.
+// Memory, CPU and process limits require that jobs.cgroup is set when using the host or sandbox executors
+type Limits struct {
+	// Maximum memory usage in megabytes
+	MemoryMB int `fig:"memory_mb"`
+	// Number of CPUs the script may use, e.g. 0.5 or 2
+	CPUs float64 `fig:"cpus"`
+	// Maximum number of processes
+	PIDs int `fig:"pids"`
+	// Maximum size of the job folder in megabytes
+	DiskMB int `fig:"disk_mb"`
+	// Maximum total size of the artifacts of a job in megabytes
+	ArtifactsMB int `fig:"artifacts_mb"`
+}
+
+// Cache describes a folder that is kept between jobs of the same repository, e.g. for downloaded dependencies
+type Cache struct {
+	// Name of the cache. Scripts find the folder in the variable MICROCI_CACHE_<NAME>
+	Name string `fig:"name" validate:"required"`
+	// Files in the repository, e.g. go.sum, whose contents decide which copy of the cache is used.
+	// If no files are set, one copy of the cache is kept per branch
+	Files []string `fig:"files"`
+}
+
+// ScriptSettings contains settings that can be set globally, per repository or per script
+type ScriptSettings struct {
+	Executor Executor `fig:"executor"`
+	Limits   Limits   `fig:"limits"`
+	// Static environment variables passed to scripts
+	Variables map[string]string `fig:"variables"`
+	// How the repository is checked out before running the script. "builtin" (default) uses git directly,
+	// and "script" runs prepare-push.sh or prepare-pr.sh from the resource folder
+	Checkout string `fig:"checkout"`
+	// Caches restored before the script is executed, and saved if it succeeds
+	Caches []Cache `fig:"caches"`
+}
+
+// Merge returns the settings in s, overridden by all settings that are set in o
+func (s ScriptSettings) Merge(o ScriptSettings) ScriptSettings {
+	if o.Executor.Type != "" {
+		s.Executor.Type = o.Executor.Type
+	}
+	if o.Executor.Image != "" {
+		s.Executor.Image = o.Executor.Image
+	}
+	if o.Executor.Runtime != "" {
+		s.Executor.Runtime = o.Executor.Runtime
+	}
+	if o.Executor.Network != "" {
+		s.Executor.Network = o.Executor.Network
+	}
+	if o.Limits.MemoryMB != 0 {
+		s.Limits.MemoryMB = o.Limits.MemoryMB
+	}
+	if o.Limits.CPUs != 0 {
+		s.Limits.CPUs = o.Limits.CPUs
+	}
+	if o.Limits.PIDs != 0 {
+		s.Limits.PIDs = o.Limits.PIDs
+	}
+	if o.Limits.DiskMB != 0 {
+		s.Limits.DiskMB = o.Limits.DiskMB
+	}
+	if o.Limits.ArtifactsMB != 0 {
+		s.Limits.ArtifactsMB = o.Limits.ArtifactsMB
+	}
+	if o.Checkout != "" {
+		s.Checkout = o.Checkout
+	}
+	if len(o.Caches) > 0 {
+		s.Caches = o.Caches
+	}
+	if len(o.Variables) > 0 {
+		variables := map[string]string{}
+		for k, v := range s.Variables {
+			variables[k] = v
+		}
+		for k, v := range o.Variables {
+			variables[k] = v
+		}
+		s.Variables = variables
+	}
+	return s
+}
+
+// Repository contains settings for a single repository
+type Repository struct {
+	// If contexts are specified, each webhook event results in one job per context
+	Contexts  []Context  `fig:"contexts"`
+	Schedules []Schedule `fig:"schedules"`
+
+	// Settings for all scripts in the repository, which can be overridden per script name
+	ScriptSettings `fig:",squash"`
+	Scripts        map[string]ScriptSettings `fig:"scripts"`
+}
+
+// ForScript returns the settings to use for a specific script in the repository,
+// based on the supplied defaults
+func (r *Repository) ForScript(defaults ScriptSettings, script string) ScriptSettings {
+	s := defaults.Merge(r.ScriptSettings)
+	if override, ok := r.Scripts[filepath.Base(script)]; ok {
+		s = s.Merge(override)
+	}
+	return s
+}
+
+// LoadRepository reads the repository settings in folder.
+// If no settings file exists, or if it is empty, empty settings are returned
+func LoadRepository(folder string) (*Repository, error) {
+	r := &Repository{}
+	err := fig.Load(r, fig.File(RepositoryFile), fig.Dirs(folder))
+	if errors.Is(err, fig.ErrFileNotFound) || errors.Is(err, io.EOF) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
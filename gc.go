@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/yzzyx/microci/job"
+)
+
+// RunCollector periodically removes old jobs according to the configured retention policies,
+// until ctx is cancelled
+func (m *Manager) RunCollector(ctx context.Context) {
+	interval := m.cfg.Jobs.Retention.Interval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		m.collectJobs()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// jobTime returns the time used to decide the age of a job
+func jobTime(j *job.Job) time.Time {
+	if !j.Finished.IsZero() {
+		return j.Finished
+	}
+	return j.Created
+}
+
+// dirSize returns the total size of all files in a folder
+func dirSize(folder string) int64 {
+	var size int64
+	_ = filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// collectJobs removes jobs, or parts of jobs, that should no longer be kept
+func (m *Manager) collectJobs() {
+	retention := m.cfg.Jobs.Retention
+	now := time.Now()
+
+	remove := map[*job.Job]bool{}
+	var candidates []*job.Job
+
+	for _, repo := range m.GetRepos() {
+		for _, q := range repo.GetQueues() {
+			successful := 0
+			finished := 0 // Finished jobs not kept by KeepSuccessful, newest first
+			for _, j := range q.GetJobs() {
+				if !j.Status.IsFinished() {
+					continue
+				}
+
+				// Keep the last N successful jobs, regardless of other policies
+				if j.Status == job.StatusSuccess && successful < retention.KeepSuccessful {
+					successful++
+					continue
+				}
+				candidates = append(candidates, j)
+
+				finished++
+				if retention.MaxPerQueue > 0 && finished > retention.MaxPerQueue {
+					remove[j] = true
+				}
+				if retention.MaxAge > 0 && now.Sub(jobTime(j)) > retention.MaxAge {
+					remove[j] = true
+				}
+			}
+		}
+	}
+
+	for j := range remove {
+		m.removeJob(j)
+	}
+
+	// Remove checkouts separately, since logs and artifacts may be kept for longer
+	if retention.CheckoutMaxAge > 0 {
+		for _, j := range candidates {
+			if remove[j] || now.Sub(jobTime(j)) <= retention.CheckoutMaxAge {
+				continue
+			}
+
+			gitFolder := filepath.Join(j.Folder, "git")
+			if !isDir(gitFolder) {
+				continue
+			}
+
+			err := os.RemoveAll(gitFolder)
+			if err != nil {
+				log.Printf("Could not remove checkout of job %s: %v", j.ID, err)
+			}
+		}
+	}
+
+	if retention.ArtifactsMaxAge > 0 {
+		for _, j := range candidates {
+			if remove[j] || j.ArtifactsRemoved || now.Sub(jobTime(j)) <= retention.ArtifactsMaxAge {
+				continue
+			}
+
+			err := j.RemoveArtifacts()
+			if err != nil {
+				log.Printf("Could not remove artifacts of job %s: %v", j.ID, err)
+			}
+		}
+	}
+
+	// Caches are shared by all jobs of a repository, so they are removed when they are no longer used, instead of with jobs
+	if m.cfg.Cache.MaxAge > 0 {
+		err := job.RemoveUnusedCaches(m.cfg.Cache.Folder, m.cfg.Cache.MaxAge)
+		if err != nil {
+			log.Printf("Could not remove unused caches: %v", err)
+		}
+	}
+
+	if retention.MaxDiskUsage <= 0 {
+		return
+	}
+
+	maxSize := retention.MaxDiskUsage * 1024 * 1024
+	size := dirSize(m.cfg.Jobs.Folder)
+	if size <= maxSize {
+		return
+	}
+
+	// Remove the oldest jobs until we're below the limit
+	sort.Slice(candidates, func(i, k int) bool {
+		return jobTime(candidates[i]).Before(jobTime(candidates[k]))
+	})
+
+	for _, j := range candidates {
+		if size <= maxSize {
+			break
+		}
+		if remove[j] {
+			continue
+		}
+
+		size -= dirSize(j.Folder)
+		m.removeJob(j)
+	}
+}
+
+// removeJob removes a job from memory, and deletes its folder
+func (m *Manager) removeJob(j *job.Job) {
+	log.Printf("Removing job %s", j.ID)
+
+	m.jobsMutex.Lock()
+	delete(m.jobs, j.ID)
+	m.jobsMutex.Unlock()
+
+	if repo := m.FindRepo(j.CommitRepo); repo != nil {
+		repo.GetQueue(j.QueueName, j.Context).RemoveJob(j.ID)
+	}
+
+	err := os.RemoveAll(j.Folder)
+	if err != nil {
+		log.Printf("Could not remove job folder %s: %v", j.Folder, err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+	"github.com/yzzyx/microci/job"
+)
+
+// giteaBranch describes a branch returned by the gitea API
+type giteaBranch struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+// getRepository returns information about a repository
+func getRepository(api *gitea.API, repo string) (gitea.Repository, error) {
+	var r gitea.Repository
+	err := job.GiteaRequest(api, http.MethodGet, path.Join("repos", repo), nil, &r)
+	return r, err
+}
+
+// getBranchCommit returns the ID of the head commit of a branch
+func getBranchCommit(api *gitea.API, repo, branch string) (string, error) {
+	var b giteaBranch
+	err := job.GiteaRequest(api, http.MethodGet, path.Join("repos", repo, "branches", branch), nil, &b)
+	if err != nil {
+		return "", err
+	}
+	return b.Commit.ID, nil
+}
@@ -0,0 +1,185 @@
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Artifact describes a file stored by a script in the artifact folder of a job
+type Artifact struct {
+	Path   string `json:"path"` // Slash separated path, relative to the artifact folder
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// FormattedSize returns the size of the artifact in a human readable form
+func (a Artifact) FormattedSize() string {
+	if a.Size < 1024 {
+		return fmt.Sprintf("%d B", a.Size)
+	}
+
+	units := []string{"KB", "MB", "GB"}
+	size := float64(a.Size) / 1024
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+// EscapedPath returns the path of the artifact, escaped for use in URLs
+func (a Artifact) EscapedPath() string {
+	return EscapeArtifactPath(a.Path)
+}
+
+// EscapeArtifactPath escapes each element of a slash separated path for use in URLs
+func EscapeArtifactPath(p string) string {
+	parts := strings.Split(p, "/")
+	for k := range parts {
+		parts[k] = url.PathEscape(parts[k])
+	}
+	return strings.Join(parts, "/")
+}
+
+// ArtifactFolder returns the folder where scripts store the artifacts of the job
+func (j *Job) ArtifactFolder() string {
+	return filepath.Join(j.Folder, "artifacts")
+}
+
+// WalkArtifacts calls fn for each artifact in folder, with the path of the artifact relative to folder.
+// Only regular files are artifacts. Symlinks are skipped, since they may point outside of the folder
+func WalkArtifacts(folder string, fn func(rel string, info os.FileInfo) error) error {
+	return filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(folder, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// ListArtifacts returns the artifacts of the job, sorted by path.
+// Once the job has finished, the artifacts recorded at that time are returned
+func (j *Job) ListArtifacts() []Artifact {
+	j.mx.Lock()
+	recorded, removed := j.Artifacts, j.ArtifactsRemoved
+	j.mx.Unlock()
+	if recorded != nil || removed {
+		return recorded
+	}
+
+	var list []Artifact
+	_ = WalkArtifacts(j.ArtifactFolder(), func(rel string, info os.FileInfo) error {
+		list = append(list, Artifact{Path: rel, Size: info.Size()})
+		return nil
+	})
+	return list
+}
+
+// fileChecksum returns the hex encoded sha256 checksum of a file
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordArtifacts records the size and checksum of all artifacts of the job.
+// If the artifacts are larger than the artifact size limit, they are removed, and a LimitError is returned
+func (j *Job) recordArtifacts() error {
+	folder := j.ArtifactFolder()
+	list := []Artifact{}
+	var total int64
+	err := WalkArtifacts(folder, func(rel string, info os.FileInfo) error {
+		sum, err := fileChecksum(filepath.Join(folder, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		list = append(list, Artifact{Path: rel, Size: info.Size(), SHA256: sum})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if limit := int64(j.Settings.Limits.ArtifactsMB) * 1024 * 1024; limit > 0 && total > limit {
+		fmt.Fprintf(j.logFile, "[[stderr]]Artifacts use %d bytes, which is more than the limit of %d MB. The artifacts have been removed\n",
+			total, j.Settings.Limits.ArtifactsMB)
+		err = removeContents(folder)
+		if err != nil {
+			return err
+		}
+		list = []Artifact{}
+		err = &LimitError{Limit: "artifact size limit"}
+	}
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Path < list[b].Path
+	})
+
+	j.mx.Lock()
+	j.Artifacts = list
+	j.mx.Unlock()
+	return err
+}
+
+// RemoveArtifacts removes all artifacts of the job, while keeping the rest of the job folder
+func (j *Job) RemoveArtifacts() error {
+	err := removeContents(j.ArtifactFolder())
+	if err != nil {
+		return err
+	}
+
+	j.mx.Lock()
+	j.Artifacts = nil
+	j.ArtifactsRemoved = true
+	j.mx.Unlock()
+	return j.Save()
+}
+
+// removeContents removes everything in folder, but keeps the folder itself
+func removeContents(folder string) error {
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		err = os.RemoveAll(filepath.Join(folder, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
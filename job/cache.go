@@ -0,0 +1,285 @@
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// validCacheName matches the names that can be used for caches, which are used both in paths and variable names
+var validCacheName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// invalidKeyChars matches characters in branch names that are not used in cache keys
+var invalidKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// CacheResult describes how a cache was used by a job
+type CacheResult struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Hit   bool   `json:"hit"`   // The cache was restored from an earlier job
+	Saved bool   `json:"saved"` // The cache was saved after the job
+}
+
+// cacheLocks contains one lock per stored cache, which prevents a cache from being restored while it is replaced
+var cacheLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockCache locks the stored cache in folder, and returns a function which unlocks it
+func lockCache(folder string) func() {
+	cacheLocks.Lock()
+	mx, ok := cacheLocks.m[folder]
+	if !ok {
+		mx = &sync.Mutex{}
+		cacheLocks.m[folder] = mx
+	}
+	cacheLocks.Unlock()
+
+	mx.Lock()
+	return mx.Unlock
+}
+
+// cacheVariableName returns the name of the variable containing the folder of a cache
+func cacheVariableName(name string) string {
+	return "MICROCI_CACHE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// cacheVariables returns the variables containing the folder of each cache used by the job
+func (j *Job) cacheVariables() []string {
+	var list []string
+	for _, c := range j.Settings.Caches {
+		if !validCacheName.MatchString(c.Name) {
+			continue
+		}
+		p, _ := filepath.Abs(j.cacheFolder(c.Name))
+		list = append(list, cacheVariableName(c.Name)+"="+p)
+	}
+	return list
+}
+
+// cacheFolder returns the folder in the job folder where a cache is restored
+func (j *Job) cacheFolder(name string) string {
+	return filepath.Join(j.Folder, "caches", name)
+}
+
+// storedCache returns the folder where a cache is kept between jobs
+func (j *Job) storedCache(name, key string) string {
+	return filepath.Join(j.Config.Cache.Folder, "caches", filepath.Clean("/"+j.CommitRepo), name, key)
+}
+
+// cacheKey returns the key of a cache, which is either based on the branch of the job,
+// or on the contents of the files listed for the cache
+func (j *Job) cacheKey(c config.Cache) (string, error) {
+	if len(c.Files) == 0 {
+		branch := j.headRef()
+		if branch == "" {
+			branch = j.QueueName
+		}
+		return "branch-" + invalidKeyChars.ReplaceAllString(branch, "_"), nil
+	}
+
+	h := sha256.New()
+	for _, name := range c.Files {
+		data, err := ioutil.ReadFile(filepath.Join(j.Folder, "git", filepath.Clean("/"+name)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	return "files-" + hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// restoreCaches copies the stored caches of the job into the job folder.
+// Caches that cannot be restored are left empty, and don't fail the job
+func (j *Job) restoreCaches() {
+	for _, c := range j.Settings.Caches {
+		if !validCacheName.MatchString(c.Name) {
+			fmt.Fprintf(j.logFile, "[[stderr]]Invalid cache name '%s', only letters, digits, '-' and '_' may be used\n", c.Name)
+			continue
+		}
+
+		result := CacheResult{Name: c.Name}
+		folder := j.cacheFolder(c.Name)
+		err := os.MkdirAll(folder, 0755)
+		if err == nil {
+			result.Key, err = j.cacheKey(c)
+		}
+		if err != nil {
+			fmt.Fprintf(j.logFile, "[[stderr]]Could not restore cache %s: %v\n", c.Name, err)
+			continue
+		}
+
+		stored := j.storedCache(c.Name, result.Key)
+		unlock := lockCache(stored)
+		if st, statErr := os.Stat(stored); statErr == nil && st.IsDir() {
+			err = copyDir(stored, folder)
+			result.Hit = err == nil
+		}
+		if result.Hit {
+			// The modification time tells when the cache was last used, see RemoveUnusedCaches
+			now := time.Now()
+			_ = os.Chtimes(stored, now, now)
+		}
+		unlock()
+
+		if err != nil {
+			fmt.Fprintf(j.logFile, "[[stderr]]Could not restore cache %s: %v\n", c.Name, err)
+			// Don't leave a partially restored cache behind
+			_ = os.RemoveAll(folder)
+			_ = os.MkdirAll(folder, 0755)
+		} else if result.Hit {
+			fmt.Fprintf(j.logFile, "Restored cache %s (%s)\n", c.Name, result.Key)
+		} else {
+			fmt.Fprintf(j.logFile, "Cache %s (%s) not found\n", c.Name, result.Key)
+		}
+
+		j.mx.Lock()
+		j.Caches = append(j.Caches, result)
+		j.mx.Unlock()
+	}
+}
+
+// saveCaches stores the caches of the job, so that they can be restored by later jobs.
+// Caches with keys based on file contents are only saved if they didn't exist before,
+// while caches kept per branch are always replaced
+func (j *Job) saveCaches() {
+	// Pull requests from forks could otherwise replace the caches used by other branches
+	if j.IsForkPullRequest() {
+		fmt.Fprintf(j.logFile, "Caches are not saved for pull requests from forked repositories\n")
+		return
+	}
+
+	for k := range j.Caches {
+		result := j.Caches[k]
+		if result.Hit && strings.HasPrefix(result.Key, "files-") {
+			continue
+		}
+
+		err := j.saveCache(result)
+		if err != nil {
+			fmt.Fprintf(j.logFile, "[[stderr]]Could not save cache %s: %v\n", result.Name, err)
+			continue
+		}
+		fmt.Fprintf(j.logFile, "Saved cache %s (%s)\n", result.Name, result.Key)
+
+		j.mx.Lock()
+		j.Caches[k].Saved = true
+		j.mx.Unlock()
+	}
+}
+
+// saveCache copies a cache from the job folder, and replaces the stored cache with it
+func (j *Job) saveCache(result CacheResult) error {
+	stored := j.storedCache(result.Name, result.Key)
+	err := os.MkdirAll(filepath.Dir(stored), 0755)
+	if err != nil {
+		return err
+	}
+
+	// The cache is copied before taking the lock, so that other jobs can restore the old copy meanwhile
+	tmp, err := ioutil.TempDir(filepath.Dir(stored), "."+result.Key+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = copyDir(j.cacheFolder(result.Name), tmp)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockCache(stored)
+	defer unlock()
+
+	err = os.RemoveAll(stored)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, stored)
+}
+
+// RemoveUnusedCaches removes the stored caches in the cache folder that have not been restored or saved by any job
+// for longer than maxAge. This also removes the caches of branches that no longer exist, and old file based keys
+func RemoveUnusedCaches(cacheFolder string, maxAge time.Duration) error {
+	// Stored caches are found in caches/<owner>/<repo>/<name>/<key>
+	list, err := filepath.Glob(filepath.Join(cacheFolder, "caches", "*", "*", "*", "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range list {
+		unlock := lockCache(stored)
+		st, err := os.Stat(stored)
+		if err == nil && time.Since(st.ModTime()) > maxAge {
+			err = os.RemoveAll(stored)
+		}
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir copies all files, folders and symlinks in src to dst, which must exist
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			// Folders are kept writable, so that the copy can be replaced or removed later.
+			// Some tools, such as go, create read-only folders in their caches
+			return os.Mkdir(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// copyFile copies the contents of src to a new file dst, with permissions mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
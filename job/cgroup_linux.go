@@ -0,0 +1,182 @@
+//go:build linux
+// +build linux
+
+package job
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// CgroupExecName is the process name used when microci is started to execute a script in a cgroup
+const CgroupExecName = "microci-cgroup-exec"
+
+// SetupCgroup prepares a cgroup v2 folder, which has been delegated to microci, for running jobs.
+// Cgroups with enabled controllers cannot contain processes, so if microci itself is running
+// in the cgroup, it's moved to a child cgroup
+func SetupCgroup(base string) error {
+	procs, err := ioutil.ReadFile(filepath.Join(base, "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("cannot read cgroup %s: %w", base, err)
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	for _, pid := range strings.Fields(string(procs)) {
+		if pid != self {
+			continue
+		}
+
+		service := filepath.Join(base, "microci")
+		err = os.MkdirAll(service, 0755)
+		if err != nil {
+			return err
+		}
+		err = joinCgroup(service)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(base, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot enable memory, cpu and pids controllers in %s: %w", base, err)
+	}
+	return nil
+}
+
+// cgroup is a cgroup v2 used to limit the resources available to a single script
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a cgroup in base, with the supplied limits
+func newCgroup(base string, name string, limits config.Limits) (*cgroup, error) {
+	c := &cgroup{path: filepath.Join(base, name)}
+	err := os.Mkdir(c.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(file string, value string) {
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(c.path, file), []byte(value), 0644)
+		}
+	}
+
+	if limits.MemoryMB > 0 {
+		write("memory.max", strconv.Itoa(limits.MemoryMB*1024*1024))
+		// Don't let the script avoid the limit by using swap
+		if isFile(filepath.Join(c.path, "memory.swap.max")) {
+			write("memory.swap.max", "0")
+		}
+	}
+	if limits.CPUs > 0 {
+		period := 100000
+		write("cpu.max", fmt.Sprintf("%d %d", int(limits.CPUs*float64(period)), period))
+	}
+	if limits.PIDs > 0 {
+		write("pids.max", strconv.Itoa(limits.PIDs))
+	}
+
+	if err != nil {
+		_ = os.Remove(c.path)
+		return nil, fmt.Errorf("cannot set limits for cgroup %s: %w", c.path, err)
+	}
+	return c, nil
+}
+
+// events returns the counters in one of the *.events files of the cgroup
+func (c *cgroup) events(file string) map[string]int {
+	f, err := os.Open(filepath.Join(c.path, file))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	events := map[string]int{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 2 {
+			events[fields[0]], _ = strconv.Atoi(fields[1])
+		}
+	}
+	return events
+}
+
+// exceeded returns the limit that made the kernel kill a process in the cgroup, if any.
+// Reaching the process limit only makes new processes fail to start, and the script decides how to handle that,
+// so it is written to out instead of being reported as a limit
+func (c *cgroup) exceeded(out io.Writer) string {
+	if c.events("memory.events")["oom_kill"] > 0 {
+		return "memory limit"
+	}
+	if n := c.events("pids.events")["max"]; n > 0 {
+		fmt.Fprintf(out, "[[stderr]]Process limit reached, %d processes could not be started\n", n)
+	}
+	return ""
+}
+
+// remove kills any processes still running in the cgroup, and removes it
+func (c *cgroup) remove() error {
+	killed := func() bool {
+		return c.events("cgroup.events")["populated"] == 0
+	}
+
+	if !killed() {
+		err := ioutil.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+		if err != nil {
+			// cgroup.kill is only available in linux 5.14 and later
+			procs, _ := ioutil.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+			for _, p := range strings.Fields(string(procs)) {
+				pid, _ := strconv.Atoi(p)
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		waitFor(killed, 5*time.Second)
+	}
+	return os.Remove(c.path)
+}
+
+// joinCgroup moves the current process to the cgroup at path
+func joinCgroup(path string) error {
+	err := ioutil.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot join cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// CgroupExec is called when microci is started to execute a script in a cgroup.
+// The script is executed after joining the cgroup, so that all processes started by it are limited
+func CgroupExec(args []string) {
+	flags := flag.NewFlagSet(CgroupExecName, flag.ExitOnError)
+	path := flags.String("cgroup", "", "cgroup to execute script in")
+	_ = flags.Parse(args)
+
+	if *path == "" || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "%s: cgroup and script must be specified\n", CgroupExecName)
+		os.Exit(1)
+	}
+
+	err := joinCgroup(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", CgroupExecName, err)
+		os.Exit(1)
+	}
+
+	err = syscall.Exec(flags.Arg(0), flags.Args(), os.Environ())
+	fmt.Fprintf(os.Stderr, "Could not execute %s: %v\n", flags.Arg(0), err)
+	os.Exit(1)
+}
@@ -0,0 +1,49 @@
+//go:build !linux
+// +build !linux
+
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// CgroupExecName is the process name used when microci is started to execute a script in a cgroup
+const CgroupExecName = "microci-cgroup-exec"
+
+var errNoCgroups = errors.New("resource limits are only supported on linux")
+
+// SetupCgroup always returns an error, since cgroups are only available on linux
+func SetupCgroup(base string) error {
+	return errNoCgroups
+}
+
+type cgroup struct {
+	path string
+}
+
+func newCgroup(base string, name string, limits config.Limits) (*cgroup, error) {
+	return nil, errNoCgroups
+}
+
+func (c *cgroup) exceeded(out io.Writer) string {
+	return ""
+}
+
+func (c *cgroup) remove() error {
+	return nil
+}
+
+func joinCgroup(path string) error {
+	return errNoCgroups
+}
+
+// CgroupExec is never used on this platform
+func CgroupExec(args []string) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", CgroupExecName, errNoCgroups)
+	os.Exit(1)
+}
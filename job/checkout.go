@@ -0,0 +1,313 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// CheckoutError is returned when the repository could not be checked out
+type CheckoutError struct {
+	Err error
+}
+
+func (e *CheckoutError) Error() string {
+	return "checkout failed: " + e.Err.Error()
+}
+
+func (e *CheckoutError) Unwrap() error {
+	return e.Err
+}
+
+// lineWriter writes the output of a command line by line, with a prefix added to each line
+type lineWriter struct {
+	out    io.Writer
+	mx     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexAny(w.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		w.writeLine(w.buf[:idx])
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any remaining output that did not end with a newline
+func (w *lineWriter) Flush() {
+	w.writeLine(w.buf)
+	w.buf = nil
+}
+
+func (w *lineWriter) writeLine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+	w.mx.Lock()
+	fmt.Fprintf(w.out, "%s%s\n", w.prefix, line)
+	w.mx.Unlock()
+}
+
+// git runs git in dir, with the output written to out.
+// If out is nil, the output is discarded, and errors include the output from stderr instead
+type git struct {
+	ctx context.Context
+	dir string
+	env []string
+	out io.Writer
+}
+
+// gitEnvironment returns the environment variables which makes git authenticate to gitea
+// with the credentials used by microci. The credentials are only sent to the gitea server,
+// and are passed in the environment so that they are not visible in the process list
+func gitEnvironment(api *gitea.API, giteaURL string) []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	var auth string
+	if api != nil && api.Token != "" {
+		auth = "token " + api.Token
+	} else if api != nil && api.Username != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(api.Username+":"+api.Password))
+	}
+
+	if auth != "" && giteaURL != "" {
+		url := strings.TrimSuffix(giteaURL, "/") + "/"
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+url+".extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: "+auth)
+	}
+	return env
+}
+
+// newGit returns a git runner which authenticates to gitea, and writes its output to the job log
+func (j *Job) newGit(ctx context.Context, dir string) *git {
+	env := j.environment(gitEnvironment(j.API, j.Config.Gitea.URL))
+	return &git{ctx: ctx, dir: dir, env: env, out: j.logFile}
+}
+
+// run executes git with args, and logs the command and its output
+func (g *git) run(args ...string) error {
+	mx := &sync.Mutex{}
+	stdout := &lineWriter{out: ioutil.Discard, mx: mx}
+	stderr := &lineWriter{out: &bytes.Buffer{}, mx: mx}
+	if g.out != nil {
+		fmt.Fprintf(g.out, "[[stderr]]+ git %s\n", strings.Join(args, " "))
+		stdout.out = g.out
+		stderr.out = g.out
+		stderr.prefix = "[[stderr]]"
+	}
+
+	cmd := exec.CommandContext(g.ctx, "git", args...)
+	cmd.Dir = g.dir
+	cmd.Env = g.env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	if err != nil {
+		if buf, ok := stderr.out.(*bytes.Buffer); ok && buf.Len() > 0 {
+			return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(buf.String()))
+		}
+		return fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// hasCommit returns true if sha exists in the repository
+func (g *git) hasCommit(sha string) bool {
+	cmd := exec.CommandContext(g.ctx, "git", "cat-file", "-e", sha+"^{commit}")
+	cmd.Dir = g.dir
+	cmd.Env = g.env
+	return cmd.Run() == nil
+}
+
+// checkout fetches the repository into the git folder of the job, and checks out the commit to test.
+// Pull requests are merged into their target branch
+func (j *Job) checkout() error {
+	ctx, cancel := context.WithTimeout(j.ctx, j.Config.Jobs.MaxExecutionTime)
+	defer cancel()
+
+	dir, err := filepath.Abs(filepath.Join(j.Folder, "git"))
+	if err != nil {
+		return err
+	}
+
+	g := j.newGit(ctx, dir)
+	err = j.checkoutCommit(g)
+	if err == nil {
+		err = j.checkoutExtras(g)
+	}
+
+	if err != nil {
+		fmt.Fprintf(j.logFile, "[[stderr]]%v\n", err)
+
+		// Don't leave a partial checkout behind
+		_ = removeContents(dir)
+
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return errExecCancelled
+		} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errExecTimedOut
+		}
+		return &CheckoutError{Err: err}
+	}
+	return nil
+}
+
+// checkoutCommit checks out the commit to test. If the repository has a mirror, the mirror is locked
+// until the checkout no longer depends on it, so that no objects are removed from the mirror meanwhile
+func (j *Job) checkoutCommit(g *git) error {
+	if j.Mirror != nil {
+		j.Mirror.mx.Lock()
+		defer j.Mirror.mx.Unlock()
+	}
+
+	var err error
+	if j.Type == gitea.EventTypePush {
+		err = j.checkoutPush(g)
+	} else {
+		err = j.checkoutPullRequest(g)
+	}
+	if err != nil || j.Mirror == nil {
+		return err
+	}
+	return j.Mirror.dissociate(g)
+}
+
+// fetch initializes the repository, and fetches all branches and tags from url.
+// If the repository has a mirror, it is updated first, and objects that already exist
+// in the mirror are used from there instead of being fetched again.
+// The caller must hold the lock of the mirror
+func (j *Job) fetch(g *git, url string) error {
+	err := g.run("init", "--quiet")
+	if err != nil {
+		return err
+	}
+
+	if j.Mirror != nil {
+		err = j.Mirror.use(g, url)
+		if err != nil {
+			fmt.Fprintf(g.out, "[[stderr]]Could not use git mirror, fetching without it: %v\n", err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"remote", "add", "origin", url},
+		{"fetch", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"},
+	} {
+		err := g.run(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutPush checks out the pushed commit, or the head of the branch if the commit isn't known
+func (j *Job) checkoutPush(g *git) error {
+	err := j.fetch(g, j.Event.Repository.CloneURL)
+	if err != nil {
+		return err
+	}
+
+	target := "remotes/origin/" + strings.TrimPrefix(j.Event.Ref, "refs/heads/")
+	if strings.HasPrefix(j.Event.Ref, "refs/tags/") {
+		target = j.Event.Ref
+	}
+
+	if !isNullCommit(j.Event.After) {
+		target = j.Event.After
+
+		// The commit may no longer be reachable from any branch, e.g. after a force push
+		if !g.hasCommit(target) {
+			err = g.run("fetch", "origin", target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return g.run("checkout", "-B", "target", target)
+}
+
+// checkoutPullRequest merges the head of the pull request into the target branch
+func (j *Job) checkoutPullRequest(g *git) error {
+	pr := j.Event.PullRequest
+	err := j.fetch(g, pr.Base.Repo.CloneURL)
+	if err != nil {
+		return err
+	}
+
+	for _, args := range [][]string{
+		// These are necessary for merge commits
+		{"config", "user.email", "microci@micro.ci"},
+		{"config", "user.name", "microci"},
+		{"checkout", "-B", "target", "remotes/origin/" + pr.Base.Ref},
+		{"fetch", pr.Head.Repo.CloneURL, "+refs/heads/" + pr.Head.Ref + ":refs/heads/source"},
+		{"merge", "--no-edit", "source"},
+	} {
+		err = g.run(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutExtras checks out submodules, and LFS files if git-lfs is installed
+func (j *Job) checkoutExtras(g *git) error {
+	if isFile(filepath.Join(g.dir, ".gitmodules")) {
+		err := g.run("submodule", "update", "--init", "--recursive")
+		if err != nil {
+			return err
+		}
+	}
+
+	attributes, err := ioutil.ReadFile(filepath.Join(g.dir, ".gitattributes"))
+	if err != nil || !bytes.Contains(attributes, []byte("filter=lfs")) {
+		return nil
+	}
+
+	if _, err = exec.LookPath("git-lfs"); err != nil {
+		fmt.Fprintf(j.logFile, "[[stderr]]Repository uses LFS, but git-lfs is not installed. LFS files will not be available\n")
+		return nil
+	}
+
+	for _, args := range [][]string{
+		{"lfs", "install", "--local"},
+		{"lfs", "pull"},
+	} {
+		err = g.run(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutScript returns the script used to check out the repository, if checkout is set to "script"
+func (j *Job) checkoutScript() (string, error) {
+	prepareScript := "prepare-pr.sh"
+	if j.Type == gitea.EventTypePush {
+		prepareScript = "prepare-push.sh"
+	}
+	return filepath.Abs(filepath.Join(j.Config.ResourceDir, "scripts", prepareScript))
+}
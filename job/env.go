@@ -0,0 +1,41 @@
+package job
+
+import (
+	"os"
+	"sort"
+)
+
+// defaultEnvironment lists the variables from the environment of microci that are always passed to scripts.
+// Other variables, such as the credentials used by microci, are only passed if listed in jobs.pass_environment
+var defaultEnvironment = []string{"PATH", "HOME", "LANG"}
+
+// isDefaultEnvironment returns true if name is one of the variables in defaultEnvironment
+func isDefaultEnvironment(name string) bool {
+	for _, n := range defaultEnvironment {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// environment returns the environment for a script, consisting of the allowed variables from the
+// environment of microci, the static variables for the repository and script, and vars
+func (j *Job) environment(vars []string) []string {
+	var env []string
+	names := append(append([]string{}, defaultEnvironment...), j.Config.Jobs.PassEnvironment...)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	var static []string
+	for name, value := range j.Settings.Variables {
+		static = append(static, name+"="+value)
+	}
+	sort.Strings(static)
+
+	env = append(env, static...)
+	return append(env, vars...)
+}
@@ -2,26 +2,33 @@ package job
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
+var sectionMarker = []byte("[[microci-section]]")
+
 var (
 	errExecCancelled = errors.New("execution cancelled by user")
 	errExecTimedOut  = errors.New("execution timed out")
 )
 
-// exportVar converts a struct to a list of variables to be exported to the shell
+// exportVar converts a struct to a list of variables to be exported to the shell.
+// Nested structs and pointers to structs are exported with their field name as prefix,
+// and slices of simple values are exported as space separated lists
 func exportVar(prefix string, i interface{}) []string {
 	v := reflect.ValueOf(i)
 
@@ -42,68 +49,226 @@ func exportVar(prefix string, i interface{}) []string {
 		if prefix != "" {
 			name = prefix + "_" + name
 		}
-		if f.Kind() == reflect.Struct {
+
+		if f.Kind() == reflect.Ptr {
+			if f.IsNil() {
+				if f.Type().Elem().Kind() != reflect.Struct || f.Type().Elem() == reflect.TypeOf(time.Time{}) {
+					variableList = append(variableList, name+"=")
+				}
+				continue
+			}
+			f = f.Elem()
+		}
+
+		if f.Kind() == reflect.Struct && f.Type() != reflect.TypeOf(time.Time{}) {
 			variableList = append(variableList, exportVar(name, f.Interface())...)
 			continue
 		}
 
 		var str string
-		switch v := f.Interface().(type) {
-		case string:
-			str = v
-		case int, int32, int64:
-			str = fmt.Sprintf("%d", v)
-		case float32, float64:
-			str = fmt.Sprintf("%f", v)
+		if f.Kind() == reflect.Slice {
+			var values []string
+			for idx := 0; idx < f.Len(); idx++ {
+				if s, ok := formatValue(f.Index(idx)); ok {
+					values = append(values, s)
+				}
+			}
+			str = strings.Join(values, " ")
+		} else {
+			str, _ = formatValue(f)
 		}
 		variableList = append(variableList, name+"="+str)
 	}
 	return variableList
 }
 
+// formatValue converts a simple value to a string.
+// It returns false if the value cannot be represented as a string
+func formatValue(v reflect.Value) (string, bool) {
+	switch val := v.Interface().(type) {
+	case string:
+		return val, true
+	case bool:
+		return strconv.FormatBool(val), true
+	case int, int32, int64, uint, uint32, uint64:
+		return fmt.Sprintf("%d", val), true
+	case float32, float64:
+		return fmt.Sprintf("%f", val), true
+	case time.Time:
+		if val.IsZero() {
+			return "", true
+		}
+		return val.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// waitFor polls done until it returns true, or until timeout has passed
+func waitFor(done func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// folderSize returns the total size of all files in folder
+func folderSize(folder string) (int64, error) {
+	var size int64
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// watchDiskUsage sends the name of the exceeded limit to exceeded if the size of the job folder grows
+// larger than the disk quota, or the size of the artifact folder grows larger than the artifact limit.
+// A limit of 0 is not checked. The sizes are checked until done is closed
+func (j *Job) watchDiskUsage(quota, artifactLimit int64, exceeded chan<- string, done <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	check := func(folder string, limit int64) bool {
+		if limit <= 0 {
+			return false
+		}
+		size, err := folderSize(folder)
+		if err != nil {
+			log.Printf("Could not check disk usage of job %s: %v", j.ID, err)
+			return false
+		}
+		return size > limit
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if check(j.Folder, quota) {
+				exceeded <- "disk quota"
+				return
+			}
+			if check(j.ArtifactFolder(), artifactLimit) {
+				exceeded <- "artifact size limit"
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
 // ExecScript executes a specific script, with all information in the struct passed as 'i' exported
 // as environment variables
 func (j *Job) ExecScript(script string) error {
-	duration := j.Config.Jobs.MaxExecutionTime
-	timeoutCtx, timeoutCancel := context.WithTimeout(j.ctx, duration)
+	j.SetStatus(StatusExecuting)
+	return j.execScript(script, j.Config.Jobs.MaxExecutionTime, j.logFile, true)
+}
+
+// execScript executes a script with a timeout, and writes its output to out.
+// If trackSections is set, sections started by the script are recorded in the job
+func (j *Job) execScript(script string, timeout time.Duration, out io.Writer, trackSections bool) error {
+	timeoutCtx, timeoutCancel := context.WithTimeout(j.ctx, timeout)
 	defer timeoutCancel()
 
-	var err error
-	cmd := exec.CommandContext(timeoutCtx, script)
-	cmd.Dir = filepath.Join(j.Folder, "git")
+	executor, err := NewExecutor(j.Settings, j.Config.Jobs.Cgroup)
+	if err != nil {
+		return err
+	}
 
-	shellVariables := exportVar("", j.Event)
-	shellVariables = append(shellVariables, "ARTIFACT_DIR="+filepath.Join(j.Folder, "artifacts"))
-	cmd.Env = append(os.Environ(), shellVariables...)
+	gitFolder, err := filepath.Abs(filepath.Join(j.Folder, "git"))
+	if err != nil {
+		return err
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	artifactFolder, err := filepath.Abs(filepath.Join(j.Folder, "artifacts"))
 	if err != nil {
 		return err
 	}
 
-	stderr, err := cmd.StderrPipe()
+	// The output is read through pipes that we create ourselves, so that we can wait for the script to exit
+	// even if processes it started in the background still hold the output open
+	stdout, stdoutWriter, err := os.Pipe()
 	if err != nil {
 		return err
 	}
+	defer stdout.Close()
+	defer stdoutWriter.Close()
 
-	if err := cmd.Start(); err != nil {
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
 		return err
 	}
+	defer stderr.Close()
+	defer stderrWriter.Close()
 
-	j.SetStatus(StatusExecuting)
+	secretVariables, err := j.secretVariables()
+	if err != nil {
+		return err
+	}
+
+	shellVariables := exportVar("", j.Event)
+	shellVariables = append(shellVariables, "ARTIFACT_DIR="+artifactFolder)
+	shellVariables = append(shellVariables, j.variables()...)
+	shellVariables = append(shellVariables, secretVariables...)
+	cmd, err := executor.Command(j, script, gitFolder, j.environment(shellVariables))
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	err = cmd.Start()
+	if err != nil {
+		_, _ = executor.Cleanup(j, cmd, 0)
+		return err
+	}
+	stdoutWriter.Close()
+	stderrWriter.Close()
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
+	outMx := sync.Mutex{}
+	writeLine := func(prefix string, data []byte) {
+		// Write each line at once, so that lines from stdout and stderr are not mixed up
+		line := make([]byte, 0, len(prefix)+len(data)+1)
+		line = append(line, prefix...)
+		line = append(line, data...)
+		line = append(line, '\n')
+
+		outMx.Lock()
+		out.Write(line)
+		outMx.Unlock()
+	}
+
+	// Secrets are never written to the log
+	masker := j.secretMasker()
 	scan := func(input io.Reader, prefix string) {
 		lines := bufio.NewScanner(input)
 
 		for lines.Scan() {
-			if prefix != "" {
-				j.logFile.WriteString(prefix)
+			data := lines.Bytes()
+			if masker != nil {
+				data = []byte(masker.Replace(string(data)))
 			}
-			j.logFile.Write(lines.Bytes())
-			j.logFile.WriteString("\n")
+
+			if trackSections && prefix == "" && bytes.HasPrefix(data, sectionMarker) {
+				// Scripts may split their output into sections, which we time separately
+				j.addSection(string(bytes.TrimPrefix(data, sectionMarker)))
+			}
+			writeLine(prefix, data)
 		}
 		wg.Done()
 	}
@@ -114,22 +279,70 @@ func (j *Job) ExecScript(script string) error {
 	go scan(stderr, "[[stderr]]")
 	go scan(stdout, "")
 
-	// According to the docs, we should not call cmd.Wait until
-	// we've finished reading from stderr/stdout
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	grace := j.Config.Jobs.KillGracePeriod
+	logKilled := func(killed []string, err error) {
+		if err != nil {
+			log.Printf("Could not stop script for job %s: %v", j.ID, err)
+		}
+		for _, p := range killed {
+			log.Printf("Job %s: killed process %s after %s", j.ID, p, grace)
+			writeLine("[[stderr]]", []byte(fmt.Sprintf("Killed process %s, which was still running after %s", p, grace)))
+		}
+	}
+
+	// Stop the script if the job folder grows larger than the disk quota, or the artifacts grow too large
+	done := make(chan struct{})
+	diskCh := make(chan string, 1)
+	quota := int64(j.Settings.Limits.DiskMB) * 1024 * 1024
+	artifactLimit := int64(j.Settings.Limits.ArtifactsMB) * 1024 * 1024
+	if quota > 0 || artifactLimit > 0 {
+		go j.watchDiskUsage(quota, artifactLimit, diskCh, done)
+	}
+
+	// Stop the script if the job is cancelled or times out
+	var stopped bool
+	var limit string
+	select {
+	case err = <-waitCh:
+	case <-timeoutCtx.Done():
+		stopped = true
+		logKilled(executor.Stop(j, cmd, grace))
+		err = <-waitCh
+	case limit = <-diskCh:
+		logKilled(executor.Stop(j, cmd, grace))
+		err = <-waitCh
+	}
+	close(done)
+
+	if err != nil && !stopped && limit == "" {
+		limit = executor.LimitExceeded(j, cmd)
+	}
+
+	// Processes that the script started in the background are stopped when the script exits
+	logKilled(executor.Cleanup(j, cmd, grace))
+
+	// Processes that have left the process group may still hold the output open,
+	// so we only wait a short while for the remaining output
+	stdout.SetReadDeadline(time.Now().Add(time.Second))
+	stderr.SetReadDeadline(time.Now().Add(time.Second))
 	wg.Wait()
 
-	err = cmd.Wait()
-	if err != nil {
-		select {
-		case <-timeoutCtx.Done():
-			if errors.Is(timeoutCtx.Err(), context.Canceled) {
-				return errExecCancelled
-			}
-			return errExecTimedOut
-		default:
+	if limit != "" {
+		return &LimitError{Limit: limit}
+	}
+
+	// A stopped script may still exit successfully, e.g. if it handles SIGTERM
+	if stopped {
+		if errors.Is(timeoutCtx.Err(), context.Canceled) {
+			return errExecCancelled
 		}
-		return err
+		return errExecTimedOut
 	}
 
-	return nil
+	return err
 }
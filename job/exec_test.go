@@ -0,0 +1,114 @@
+//go:build !windows
+// +build !windows
+
+package job
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// newTestJob returns a job with its folder in a temporary folder, which is removed when the test ends
+func newTestJob(t *testing.T) *Job {
+	folder, err := ioutil.TempDir("", "microci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+
+	cfg := &config.Config{}
+	cfg.Jobs.Folder = folder
+	cfg.Jobs.KillGracePeriod = 5 * time.Second
+
+	j := &Job{Config: cfg}
+	err = j.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.logFile.Close() })
+	return j
+}
+
+// writeScript writes an executable shell script to the job folder, and returns its path
+func writeScript(t *testing.T, j *Job, body string) string {
+	p := filepath.Join(j.Folder, "script.sh")
+	err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"+body), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestExecScriptStopped(t *testing.T) {
+	// The script exits successfully when it's asked to stop
+	const trapTerm = "trap 'exit 0' TERM\nwhile true; do sleep 0.1; done\n"
+
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		cancel  bool
+		want    error
+	}{
+		{name: "success", script: "exit 0\n", timeout: time.Minute},
+		{name: "failure", script: "exit 1\n", timeout: time.Minute, want: errors.New("exit status 1")},
+		{name: "timed out", script: trapTerm, timeout: 500 * time.Millisecond, want: errExecTimedOut},
+		{name: "cancelled", script: trapTerm, timeout: time.Minute, cancel: true, want: errExecCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJob(t)
+			script := writeScript(t, j, tt.script)
+
+			if tt.cancel {
+				var cancel context.CancelFunc
+				j.ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(500*time.Millisecond, cancel)
+			}
+
+			err := j.execScript(script, tt.timeout, ioutil.Discard, false)
+			switch {
+			case tt.want == nil && err != nil:
+				t.Errorf("execScript returned %v, expected success", err)
+			case tt.want != nil && err == nil:
+				t.Errorf("execScript succeeded, expected %v", tt.want)
+			case tt.want != nil && err.Error() != tt.want.Error():
+				t.Errorf("execScript returned %v, expected %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecScriptMasksSecrets(t *testing.T) {
+	j := newTestJob(t)
+	j.Secrets = []Secret{
+		{Name: "TOKEN", Value: "hunter2"},
+		{Name: "KEY", Value: "-----BEGIN KEY-----\nabcdef\n-----END KEY-----", File: true},
+	}
+	script := writeScript(t, j, "echo \"token: $TOKEN\"\necho \"$TOKEN\" >&2\ncat \"$KEY\"\n")
+
+	out := &bytes.Buffer{}
+	err := j.execScript(script, time.Minute, out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"hunter2", "BEGIN KEY", "abcdef", "END KEY"} {
+		if strings.Contains(out.String(), value) {
+			t.Errorf("output contains %q:\n%s", value, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "token: ***\n") || !strings.Contains(out.String(), "[[stderr]]***\n") {
+		t.Errorf("output does not contain masked secrets:\n%s", out.String())
+	}
+}
@@ -0,0 +1,280 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// Executor creates and stops the processes used to execute scripts
+type Executor interface {
+	// Command returns a command that executes script in folder dir, with env as its environment
+	Command(j *Job, script string, dir string, env []string) (*exec.Cmd, error)
+	// Stop terminates a running command previously created by Command. Processes that are still running
+	// after the grace period are killed, and a description of them is returned
+	Stop(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error)
+	// Cleanup stops any processes that were left running after the command exited
+	Cleanup(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error)
+	// LimitExceeded returns the resource limit that made the command get killed, if any
+	LimitExceeded(j *Job, cmd *exec.Cmd) string
+}
+
+// LimitError is returned when a script is killed because it exceeded a resource limit
+type LimitError struct {
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("killed: %s exceeded", e.Limit)
+}
+
+// NewExecutor returns the executor described by settings.
+// cgroupBase is the cgroup used for memory, CPU and process limits by the host and sandbox executors
+func NewExecutor(settings config.ScriptSettings, cgroupBase string) (Executor, error) {
+	cfg := settings.Executor
+	switch cfg.Type {
+	case "", "host":
+		return &HostExecutor{Limits: settings.Limits, CgroupBase: cgroupBase}, nil
+	case "container":
+		if cfg.Image == "" {
+			return nil, fmt.Errorf("no image specified for container executor")
+		}
+
+		runtime := cfg.Runtime
+		if runtime == "" {
+			runtime = "docker"
+		}
+		return &ContainerExecutor{Runtime: runtime, Image: cfg.Image, Network: cfg.Network, Limits: settings.Limits}, nil
+	case "sandbox":
+		if cfg.Network != "" && cfg.Network != "host" && cfg.Network != "none" {
+			return nil, fmt.Errorf("sandbox executor only supports network 'host' or 'none'")
+		}
+		return &SandboxExecutor{DisableNetwork: cfg.Network == "none", Limits: settings.Limits, CgroupBase: cgroupBase}, nil
+	}
+	return nil, fmt.Errorf("unknown executor type '%s'", cfg.Type)
+}
+
+// scriptCgroup creates a cgroup for a script, if any limits that require a cgroup are set
+func scriptCgroup(j *Job, base string, limits config.Limits) (*cgroup, error) {
+	if limits.MemoryMB == 0 && limits.CPUs == 0 && limits.PIDs == 0 {
+		return nil, nil
+	}
+	if base == "" {
+		return nil, fmt.Errorf("memory, CPU and process limits require that 'jobs.cgroup' is set")
+	}
+
+	suffix, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	return newCgroup(base, "job-"+j.ID[:12]+"-"+suffix[:8], limits)
+}
+
+// HostExecutor executes scripts directly on the host.
+// Each script is started in its own process group, which allows us to stop all processes started by it
+type HostExecutor struct {
+	Limits     config.Limits
+	CgroupBase string
+
+	cgroup *cgroup
+}
+
+// Command returns a command that executes script directly.
+// If resource limits are set, the script is started through microci, which first moves it to a new cgroup
+func (e *HostExecutor) Command(j *Job, script string, dir string, env []string) (*exec.Cmd, error) {
+	var err error
+	e.cgroup, err = scriptCgroup(j, e.CgroupBase, e.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(script)
+	if e.cgroup != nil {
+		cmd = &exec.Cmd{
+			Path: "/proc/self/exe",
+			Args: []string{CgroupExecName, "-cgroup=" + e.cgroup.path, "--", script},
+		}
+	}
+	cmd.Dir = dir
+	cmd.Env = env
+	setProcessGroup(cmd)
+	return cmd, nil
+}
+
+// Stop terminates all processes in the process group of the script
+func (e *HostExecutor) Stop(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	return stopProcessGroup(cmd.Process.Pid, grace)
+}
+
+// Cleanup terminates any processes that the script left running in its process group,
+// and removes the cgroup of the script
+func (e *HostExecutor) Cleanup(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	var killed []string
+	var err error
+	if cmd.Process != nil {
+		killed, err = stopProcessGroup(cmd.Process.Pid, grace)
+	}
+
+	if e.cgroup != nil {
+		cgroupErr := e.cgroup.remove()
+		if err == nil {
+			err = cgroupErr
+		}
+	}
+	return killed, err
+}
+
+// LimitExceeded checks if any process in the cgroup of the script exceeded a limit
+func (e *HostExecutor) LimitExceeded(j *Job, cmd *exec.Cmd) string {
+	if e.cgroup == nil {
+		return ""
+	}
+	return e.cgroup.exceeded(j.logFile)
+}
+
+// ContainerExecutor executes scripts in a container, using the docker or podman command line tools.
+// The job folder is mounted at the same path inside the container as on the host,
+// so that paths such as ARTIFACT_DIR are the same for scripts executing in the container
+type ContainerExecutor struct {
+	Runtime string // "docker" or "podman"
+	Image   string
+	Network string // Passed to --network if set
+	Limits  config.Limits
+}
+
+// containerName returns the name of the container used to execute a script
+func (e *ContainerExecutor) containerName(j *Job, cmd *exec.Cmd) string {
+	for _, arg := range cmd.Args {
+		if strings.HasPrefix(arg, "--name=") {
+			return strings.TrimPrefix(arg, "--name=")
+		}
+	}
+	return ""
+}
+
+// Command returns a command that starts a container executing script
+func (e *ContainerExecutor) Command(j *Job, script string, dir string, env []string) (*exec.Cmd, error) {
+	jobFolder, err := filepath.Abs(j.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	// The container is removed in Cleanup, after we've checked if it was killed by exceeding a limit
+	args := []string{
+		"run", "--init",
+		"--name=microci-" + j.ID[:12] + "-" + suffix[:8],
+		fmt.Sprintf("--user=%d:%d", os.Getuid(), os.Getgid()),
+		"--volume=" + jobFolder + ":" + jobFolder,
+		"--workdir=" + dir,
+	}
+
+	// Scripts outside the job folder are mounted read-only
+	scriptDir := filepath.Dir(script)
+	if !strings.HasPrefix(scriptDir+"/", jobFolder+"/") {
+		args = append(args, "--volume="+scriptDir+":"+scriptDir+":ro")
+	}
+
+	if e.Network != "" {
+		args = append(args, "--network="+e.Network)
+	}
+
+	if e.Limits.MemoryMB > 0 {
+		// Setting memory-swap to the same value as memory disables swap
+		memory := fmt.Sprintf("%dm", e.Limits.MemoryMB)
+		args = append(args, "--memory="+memory, "--memory-swap="+memory)
+	}
+	if e.Limits.CPUs > 0 {
+		args = append(args, fmt.Sprintf("--cpus=%g", e.Limits.CPUs))
+	}
+	if e.Limits.PIDs > 0 {
+		args = append(args, fmt.Sprintf("--pids-limit=%d", e.Limits.PIDs))
+	}
+
+	// Variables are passed by name, so that the values are read from the environment
+	// of the runtime instead of being visible in the process list.
+	// Variables such as PATH and HOME are not passed, since they are set by the image
+	for _, v := range env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if !isDefaultEnvironment(name) {
+			args = append(args, "--env="+name)
+		}
+	}
+	args = append(args, e.Image, script)
+
+	cmd := exec.Command(e.Runtime, args...)
+	cmd.Dir = dir
+	cmd.Env = runtimeEnvironment(env)
+	return cmd, nil
+}
+
+// runtimeVariables lists the variables from the environment of microci that the container runtime may need
+// to reach its daemon or socket. They are passed to the runtime, but not to the container
+var runtimeVariables = []string{
+	"DOCKER_HOST", "DOCKER_CONTEXT", "DOCKER_CONFIG", "DOCKER_CERT_PATH", "DOCKER_TLS_VERIFY",
+	"CONTAINER_HOST", "CONTAINERS_CONF", "XDG_RUNTIME_DIR",
+}
+
+// runtimeEnvironment returns the environment for the container runtime, consisting of the environment of the
+// script and the variables in runtimeVariables. The rest of the environment of microci, such as its credentials, is not passed
+func runtimeEnvironment(env []string) []string {
+	names := map[string]bool{}
+	for _, v := range env {
+		names[strings.SplitN(v, "=", 2)[0]] = true
+	}
+
+	runtimeEnv := append([]string{}, env...)
+	for _, name := range runtimeVariables {
+		if value, ok := os.LookupEnv(name); ok && !names[name] {
+			runtimeEnv = append(runtimeEnv, name+"="+value)
+		}
+	}
+	return runtimeEnv
+}
+
+// Stop stops the container, which lets the runtime send SIGTERM and then SIGKILL after the grace period.
+// The container is then removed, and the runtime command is killed
+func (e *ContainerExecutor) Stop(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	var killed []string
+	if name := e.containerName(j, cmd); name != "" {
+		start := time.Now()
+		timeout := fmt.Sprintf("--time=%d", int(grace.Seconds()))
+		_ = exec.Command(e.Runtime, "stop", timeout, name).Run()
+		if time.Since(start) >= grace {
+			killed = append(killed, "container "+name)
+		}
+		_ = exec.Command(e.Runtime, "rm", "--force", name).Run()
+	}
+	return killed, cmd.Process.Kill()
+}
+
+// Cleanup removes the container. All processes in the container are stopped when the container exits
+func (e *ContainerExecutor) Cleanup(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	if name := e.containerName(j, cmd); name != "" {
+		_ = exec.Command(e.Runtime, "rm", "--force", name).Run()
+	}
+	return nil, nil
+}
+
+// LimitExceeded checks if the container was killed because it ran out of memory
+func (e *ContainerExecutor) LimitExceeded(j *Job, cmd *exec.Cmd) string {
+	name := e.containerName(j, cmd)
+	if name == "" {
+		return ""
+	}
+
+	out, err := exec.Command(e.Runtime, "inspect", "--format={{.State.OOMKilled}}", name).Output()
+	if err == nil && strings.TrimSpace(string(out)) == "true" {
+		return "memory limit"
+	}
+	return ""
+}
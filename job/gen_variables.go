@@ -0,0 +1,62 @@
+//go:build ignore
+// +build ignore
+
+// gen_variables updates the table of MICROCI_* variables in README.md from job.Variables,
+// which are also used for /help/variables. Run it with 'go generate ./job'
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/yzzyx/microci/job"
+)
+
+// The table is placed between these markers in the README
+const (
+	startMarker = "<!-- variables:start -->\n"
+	endMarker   = "<!-- variables:end -->\n"
+)
+
+// markdownEscaper escapes characters in descriptions that would otherwise be interpreted by markdown
+var markdownEscaper = strings.NewReplacer("|", `\|`, "<", "&lt;", ">", "&gt;")
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: go run gen_variables.go README.md\n")
+		os.Exit(1)
+	}
+
+	err := updateReadme(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// updateReadme replaces the contents between the markers in the README at path with the table of variables
+func updateReadme(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	start := bytes.Index(data, []byte(startMarker))
+	end := bytes.Index(data, []byte(endMarker))
+	if start < 0 || end < start {
+		return fmt.Errorf("%s must contain the markers %q and %q", path, startMarker, endMarker)
+	}
+
+	b := &bytes.Buffer{}
+	b.Write(data[:start+len(startMarker)])
+	fmt.Fprintf(b, "| Variable | Description |\n|----------|-------------|\n")
+	for _, v := range job.Variables {
+		fmt.Fprintf(b, "| `%s` | %s |\n", v.Name, markdownEscaper.Replace(v.Description))
+	}
+	b.Write(data[end:])
+
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
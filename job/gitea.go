@@ -0,0 +1,87 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// ErrNotFound is returned when a requested resource does not exist
+var ErrNotFound = errors.New("not found")
+
+// GiteaRequest performs a request against the gitea API.
+// If body is not nil, it is sent JSON-encoded, and if out is not nil,
+// the response is decoded into it
+func GiteaRequest(api *gitea.API, method string, apiPath string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		buf := &bytes.Buffer{}
+		err := json.NewEncoder(buf).Encode(body)
+		if err != nil {
+			return err
+		}
+		reader = buf
+		contentType = "application/json"
+	}
+	return GiteaRawRequest(api, method, apiPath, contentType, reader, out)
+}
+
+// GiteaRawRequest performs a request against the gitea API, with a body of the supplied content type
+func GiteaRawRequest(api *gitea.API, method string, apiPath string, contentType string, body io.Reader, out interface{}) error {
+	u, err := url.Parse(api.URL)
+	if err != nil {
+		return err
+	}
+
+	query := ""
+	if idx := strings.IndexByte(apiPath, '?'); idx >= 0 {
+		apiPath, query = apiPath[:idx], apiPath[idx+1:]
+	}
+	u.Path = path.Join(u.Path, "api", "v1", apiPath)
+	u.RawQuery = query
+
+	r, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+
+	if contentType != "" {
+		r.Header.Add("Content-Type", contentType)
+	}
+	r.Header.Add("Accept", "application/json")
+	if api.Token != "" {
+		r.Header.Add("Authorization", "token "+api.Token)
+	} else {
+		r.SetBasicAuth(api.Username, api.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: invalid status code returned: %d %s", method, apiPath, resp.StatusCode, msg)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
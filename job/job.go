@@ -28,6 +28,8 @@ var (
 	StatusError     JobStatus = 3
 	StatusCancelled JobStatus = 4
 	StatusTimeout   JobStatus = 5
+	StatusKilled    JobStatus = 6 // Killed for exceeding a resource limit
+	StatusSkipped   JobStatus = 7 // No script or repository configuration was found
 )
 
 // IsFinished returns true if status means that job is not active anymore
@@ -38,6 +40,52 @@ func (s JobStatus) IsFinished() bool {
 	return false
 }
 
+// String returns a short, human readable, name of the status
+func (s JobStatus) String() string {
+	switch s {
+	case StatusPending:
+		return "pending"
+	case StatusExecuting:
+		return "executing"
+	case StatusSuccess:
+		return "success"
+	case StatusError:
+		return "error"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusTimeout:
+		return "timeout"
+	case StatusKilled:
+		return "killed"
+	case StatusSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// Section describes a single part of the job log, e.g. the git preparation or a script run
+type Section struct {
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Duration returns the time spent in the section, or the time spent so far if it's still running
+func (s Section) Duration() time.Duration {
+	return duration(s.Started, s.Finished)
+}
+
+// duration returns the time between start and end, or between start and now if end is not set
+func duration(start, end time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(start).Truncate(time.Second)
+}
+
 // Job defines a single webhook event to be processed
 type Job struct {
 	ID         string          `json:"-"`
@@ -50,17 +98,38 @@ type Job struct {
 	Type       gitea.EventType `json:"type"`
 	Event      gitea.Event     `json:"event"`
 
-	API       *gitea.API
+	API       *gitea.API `json:"-"`
 	TargetURL string
 
 	ctx       context.Context
 	ctxCancel func()
 	logFile   *os.File
-	Config    *config.Config
+	Config    *config.Config        `json:"-"`
+	Settings  config.ScriptSettings `json:"-"` // Settings for the repository and script of the job
+	Secrets   []Secret              `json:"-"` // Decrypted secrets available to the job
+	Mirror    *Mirror               `json:"-"` // Git mirror of the repository, used when checking out
 
 	Status            JobStatus `json:"status"`
 	StatusDescription string    `json:"status_description"`
 
+	// Links between a job and the jobs created by re-running it
+	RerunOf string   `json:"rerun_of,omitempty"`
+	Reruns  []string `json:"reruns,omitempty"`
+
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Sections []Section `json:"sections"`
+
+	Caches []CacheResult `json:"caches,omitempty"`
+
+	// Artifacts recorded when the job finished, and whether they have since been removed
+	Artifacts        []Artifact `json:"artifacts,omitempty"`
+	ArtifactsRemoved bool       `json:"artifacts_removed,omitempty"`
+
+	allowedFailures []string // Pipeline steps that failed without failing the job
+	repoConfigFound bool     // A configuration was found in the repository, see PushStatus
+
 	statusUpdateMx     *sync.Mutex
 	statusCancelUpdate func()
 
@@ -77,6 +146,15 @@ func randomString() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
+func isFile(p string) bool {
+	st, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+
+	return !st.IsDir()
+}
+
 // Setup prepares the job for execution
 func (j *Job) Setup() error {
 	var err error
@@ -96,6 +174,10 @@ func (j *Job) Setup() error {
 		j.statusUpdateMx = &sync.Mutex{}
 	}
 
+	if j.Created.IsZero() {
+		j.Created = time.Now()
+	}
+
 	j.TargetURL = strings.TrimSuffix(j.TargetURL, "/") + path.Join("/job", j.ID)
 	j.Folder = filepath.Join(j.Config.Jobs.Folder, j.ID)
 	gitFolder := filepath.Join(j.Folder, "git")
@@ -125,10 +207,56 @@ func (j *Job) SetStatus(st JobStatus, description ...string) {
 
 	j.Status = st
 	j.StatusDescription = strings.Join(description, " ")
+	if st == StatusExecuting && j.Started.IsZero() {
+		j.Started = time.Now()
+	}
+	if st.IsFinished() {
+		j.finish()
+	}
+	go j.PushStatus()
+}
+
+// start marks a pending job as executing. It returns false if the job
+// is no longer pending, e.g. because it was cancelled while waiting
+func (j *Job) start(description string) bool {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if j.Status != StatusPending {
+		return false
+	}
+
+	j.Status = StatusExecuting
+	j.StatusDescription = description
+	j.Started = time.Now()
+	go j.PushStatus()
+	return true
+}
+
+// SetPendingDescription updates the description of a job that is waiting to be executed.
+// If the job has already been started or cancelled, nothing is changed
+func (j *Job) SetPendingDescription(description string) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if j.Status != StatusPending {
+		return
+	}
+
+	j.StatusDescription = description
 	go j.PushStatus()
 }
 
 func (j *Job) PushStatus() {
+	// Jobs without a server-side script only report their status once a configuration has been found
+	// in the repository, so that commits to repositories without any CI configuration get no status
+	j.mx.Lock()
+	hidden := j.Script == "" && !j.repoConfigFound
+	j.mx.Unlock()
+	if hidden {
+		return
+	}
+
 	j.statusUpdateMx.Lock()
 	if j.statusCancelUpdate != nil {
 		j.statusCancelUpdate()
@@ -147,7 +275,7 @@ func (j *Job) PushStatus() {
 	switch j.Status {
 	case StatusPending, StatusExecuting:
 		status.State = gitea.CommitStatusPending
-	case StatusCancelled, StatusTimeout:
+	case StatusCancelled, StatusTimeout, StatusKilled:
 		status.State = gitea.CommitStatusError
 	case StatusSuccess:
 		status.State = gitea.CommitStatusSuccess
@@ -172,6 +300,15 @@ func (j *Job) PushStatus() {
 	log.Printf("UpdateCommitState(%s) failed after 3 attempts. last error: %v", status.State, err)
 }
 
+// setRepoConfigFound records that a configuration was found in the repository,
+// and reports the current status of the job to gitea
+func (j *Job) setRepoConfigFound() {
+	j.mx.Lock()
+	j.repoConfigFound = true
+	j.mx.Unlock()
+	go j.PushStatus()
+}
+
 // Save job information to JSON file
 func (j *Job) Save() error {
 	j.mx.Lock()
@@ -189,8 +326,21 @@ func (j *Job) Save() error {
 	return nil
 }
 
+// AddRerun records that the job has been re-run as job id, and saves it
+func (j *Job) AddRerun(id string) error {
+	j.mx.Lock()
+	j.Reruns = append(j.Reruns, id)
+	j.mx.Unlock()
+	return j.Save()
+}
+
 // Cancel cancels an executing of pending job
 func (j *Job) Cancel() {
+	j.CancelWithDescription("cancelled")
+}
+
+// CancelWithDescription cancels an executing or pending job, and reports description as the reason
+func (j *Job) CancelWithDescription(description string) {
 	j.mx.Lock()
 	defer j.mx.Unlock()
 
@@ -198,7 +348,69 @@ func (j *Job) Cancel() {
 		j.ctxCancel()
 		j.ctxCancel = nil
 		j.Status = StatusCancelled
-		j.StatusDescription = "cancelled"
+		j.StatusDescription = description
+		j.finish()
 		go j.PushStatus()
 	}
 }
+
+// Duration returns the total execution time of the job, or the time it has been executing so far
+func (j *Job) Duration() time.Duration {
+	return duration(j.Started, j.Finished)
+}
+
+// WaitTime returns the time the job spent waiting in the queue before starting
+func (j *Job) WaitTime() time.Duration {
+	if j.Started.IsZero() {
+		return duration(j.Created, j.Finished)
+	}
+	return duration(j.Created, j.Started)
+}
+
+// StartSection marks the beginning of a new section in the log, and ends the previous one
+func (j *Job) StartSection(name string) {
+	j.addSection(name)
+	fmt.Fprintf(j.logFile, "[[microci-section]]%s\n", name)
+}
+
+// addSection records the start of a new section, and ends the previous one
+func (j *Job) addSection(name string) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	now := time.Now()
+	if n := len(j.Sections); n > 0 && j.Sections[n-1].Finished.IsZero() {
+		j.Sections[n-1].Finished = now
+	}
+	j.Sections = append(j.Sections, Section{Name: name, Started: now})
+}
+
+// endSection ends the currently open section, if any
+func (j *Job) endSection() {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if n := len(j.Sections); n > 0 && j.Sections[n-1].Finished.IsZero() {
+		j.Sections[n-1].Finished = time.Now()
+	}
+}
+
+// addCompletedSection records a section that has already finished
+func (j *Job) addCompletedSection(s Section) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	j.Sections = append(j.Sections, s)
+}
+
+// finish sets the time the job finished, and closes the currently open section.
+// The caller must hold j.mx
+func (j *Job) finish() {
+	now := time.Now()
+	if j.Finished.IsZero() {
+		j.Finished = now
+	}
+	if n := len(j.Sections); n > 0 && j.Sections[n-1].Finished.IsZero() {
+		j.Sections[n-1].Finished = now
+	}
+}
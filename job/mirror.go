@@ -0,0 +1,126 @@
+package job
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// Mirror is a bare repository shared by all jobs of a repository, which keeps the objects
+// fetched by earlier jobs. Jobs use it as a reference repository while fetching, so that only
+// new objects have to be fetched from gitea. The mirror is locked while it is in use
+type Mirror struct {
+	Path string
+
+	env []string
+	mx  *sync.Mutex
+}
+
+// NewMirror returns a mirror stored in path, which authenticates to gitea with the credentials in api.
+// The mirror is created the first time a job uses it
+func NewMirror(path string, api *gitea.API, giteaURL string) *Mirror {
+	return &Mirror{
+		Path: path,
+		env:  append(os.Environ(), gitEnvironment(api, giteaURL)...),
+		mx:   &sync.Mutex{},
+	}
+}
+
+// exists returns true if the mirror has been created
+func (m *Mirror) exists() bool {
+	st, err := os.Stat(m.Path)
+	return err == nil && st.IsDir()
+}
+
+// update fetches all branches and tags from url into the mirror, and creates the mirror if it doesn't exist.
+// If url is empty, the URL used by the last update is used. Output from git is written to out.
+// The caller must hold the lock of the mirror
+func (m *Mirror) update(ctx context.Context, url string, out io.Writer) error {
+	g := &git{ctx: ctx, dir: m.Path, env: m.env, out: out}
+
+	if !m.exists() {
+		err := os.MkdirAll(m.Path, 0755)
+		if err != nil {
+			return err
+		}
+
+		for _, args := range [][]string{
+			{"init", "--bare", "--quiet"},
+			{"config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*"},
+			{"config", "--add", "remote.origin.fetch", "+refs/tags/*:refs/tags/*"},
+		} {
+			err = g.run(args...)
+			if err != nil {
+				// Don't leave a half-initialized mirror behind
+				_ = os.RemoveAll(m.Path)
+				return err
+			}
+		}
+	}
+
+	if url == "" {
+		return g.run("fetch", "--prune", "origin")
+	}
+
+	// The URL is only saved once we know that it works
+	err := g.run("fetch", "--prune", url, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if err != nil {
+		return err
+	}
+	return g.run("config", "remote.origin.url", url)
+}
+
+// use updates the mirror from url, and adds it as a reference repository to the repository of g.
+// The caller must hold the lock of the mirror
+func (m *Mirror) use(g *git, url string) error {
+	err := m.update(g.ctx, url, g.out)
+	if err != nil {
+		return err
+	}
+
+	objects, err := filepath.Abs(filepath.Join(m.Path, "objects"))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(g.dir, ".git", "objects", "info", "alternates"), []byte(objects+"\n"), 0644)
+}
+
+// dissociate copies the objects borrowed from the mirror into the repository of g, and stops using the mirror.
+// This keeps the checkout working when objects are pruned from the mirror, and when only the job folder
+// is available to the script, e.g. in a container. The caller must hold the lock of the mirror
+func (m *Mirror) dissociate(g *git) error {
+	alternates := filepath.Join(g.dir, ".git", "objects", "info", "alternates")
+	if !isFile(alternates) {
+		return nil
+	}
+
+	err := g.run("repack", "-a", "-d", "--quiet")
+	if err != nil {
+		return err
+	}
+	return os.Remove(alternates)
+}
+
+// Maintain fetches new commits into the mirror, and lets git clean it up if needed.
+// Mirrors that have not been used by any job yet are left alone
+func (m *Mirror) Maintain(ctx context.Context) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if !m.exists() {
+		return nil
+	}
+
+	err := m.update(ctx, "", nil)
+	if err != nil {
+		return err
+	}
+
+	g := &git{ctx: ctx, dir: m.Path, env: m.env}
+	return g.run("gc", "--auto", "--quiet")
+}
@@ -0,0 +1,296 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkyr/fig"
+)
+
+// Step describes a single command or script to execute as part of a pipeline
+type Step struct {
+	Name string `fig:"name" validate:"required"`
+	// Shell commands to execute. Either this or Script must be set
+	Run string `fig:"run"`
+	// Script to execute, relative to the folder of the pipeline file
+	Script string `fig:"script"`
+	// Maximum execution time of step, defaults to the jobs max_execution_time setting
+	Timeout time.Duration `fig:"timeout"`
+	// If set, the pipeline continues even if this step fails
+	AllowFailure bool `fig:"allow_failure"`
+	// Names of steps that must have completed successfully before this step is started
+	Needs []string `fig:"needs"`
+}
+
+// Stage is a set of steps that execute in parallel. A stage is not started until the previous one has finished
+type Stage struct {
+	Name  string `fig:"name" validate:"required"`
+	Steps []Step `fig:"steps" validate:"required"`
+}
+
+// Pipeline describes a set of stages to execute in order
+type Pipeline struct {
+	Stages []Stage `fig:"stages" validate:"required"`
+
+	folder string // Folder of the pipeline file, used to locate scripts
+}
+
+// StepError is returned when a step in a pipeline fails
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step '%s': %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+var errStepSkipped = errors.New("skipped because a required step failed")
+
+// IsPipeline returns true if the file at path describes a pipeline instead of being an executable script
+func IsPipeline(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// LoadPipeline reads and validates a pipeline file
+func LoadPipeline(path string) (*Pipeline, error) {
+	p := &Pipeline{}
+	err := fig.Load(p, fig.File(filepath.Base(path)), fig.Dirs(filepath.Dir(path)))
+	if err != nil {
+		return nil, err
+	}
+
+	p.folder = filepath.Dir(path)
+	err = p.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// validate checks that all steps can be executed, and that dependencies between steps can be resolved
+func (p *Pipeline) validate() error {
+	available := map[string]bool{} // Steps in previous stages
+	for _, stage := range p.Stages {
+		inStage := map[string]*Step{}
+		for k := range stage.Steps {
+			step := &stage.Steps[k]
+			if step.Name == "" {
+				return fmt.Errorf("step without name in stage '%s'", stage.Name)
+			}
+			if available[step.Name] || inStage[step.Name] != nil {
+				return fmt.Errorf("duplicate step '%s'", step.Name)
+			}
+			if (step.Run == "") == (step.Script == "") {
+				return fmt.Errorf("step '%s' must specify exactly one of 'run' and 'script'", step.Name)
+			}
+			inStage[step.Name] = step
+		}
+
+		for _, step := range stage.Steps {
+			for _, need := range step.Needs {
+				if !available[need] && inStage[need] == nil {
+					return fmt.Errorf("step '%s' needs unknown step '%s', steps can only depend on steps in the same or earlier stages", step.Name, need)
+				}
+			}
+		}
+
+		// Make sure that steps within the stage do not depend on each other in a cycle
+		visiting := map[string]bool{}
+		done := map[string]bool{}
+		var visit func(name string) error
+		visit = func(name string) error {
+			step := inStage[name]
+			if step == nil || done[name] {
+				return nil
+			}
+			if visiting[name] {
+				return fmt.Errorf("circular dependency involving step '%s'", name)
+			}
+			visiting[name] = true
+			for _, need := range step.Needs {
+				if err := visit(need); err != nil {
+					return err
+				}
+			}
+			done[name] = true
+			return nil
+		}
+
+		for name := range inStage {
+			if err := visit(name); err != nil {
+				return err
+			}
+			available[name] = true
+		}
+	}
+	return nil
+}
+
+// stepResult keeps track of the outcome of a step, so that dependent steps can wait for it
+type stepResult struct {
+	done   chan struct{}
+	failed bool
+}
+
+// RunPipeline executes all stages in the pipeline file at path.
+// The output of each step is added to the job log as a separate section when the step has finished
+func (j *Job) RunPipeline(path string) error {
+	p, err := LoadPipeline(path)
+	if err != nil {
+		return err
+	}
+	return j.runPipeline(p)
+}
+
+// runPipeline executes all stages in a pipeline
+func (j *Job) runPipeline(p *Pipeline) error {
+	stepFolder := filepath.Join(j.Folder, "steps")
+	err := os.MkdirAll(stepFolder, 0755)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stepFolder)
+
+	j.SetStatus(StatusExecuting, "Running pipeline...")
+	j.endSection()
+
+	results := map[string]*stepResult{}
+	for _, stage := range p.Stages {
+		for _, step := range stage.Steps {
+			results[step.Name] = &stepResult{done: make(chan struct{})}
+		}
+	}
+
+	logMx := sync.Mutex{}
+	stepNum := 0
+
+	for _, stage := range p.Stages {
+		wg := sync.WaitGroup{}
+		var stageErr error
+		errMx := sync.Mutex{}
+
+		for _, step := range stage.Steps {
+			stepNum++
+			wg.Add(1)
+			go func(stage Stage, step Step, num int) {
+				defer wg.Done()
+				result := results[step.Name]
+				defer close(result.done)
+
+				err := j.runStep(p, stage, step, num, stepFolder, results, &logMx)
+				if err == nil {
+					return
+				}
+
+				result.failed = true
+				if step.AllowFailure && !errors.Is(err, errExecCancelled) {
+					errMx.Lock()
+					j.allowedFailures = append(j.allowedFailures, step.Name)
+					errMx.Unlock()
+					return
+				}
+
+				errMx.Lock()
+				if stageErr == nil || errors.Is(stageErr, errStepSkipped) {
+					stageErr = &StepError{Step: step.Name, Err: err}
+				}
+				errMx.Unlock()
+			}(stage, step, stepNum)
+		}
+		wg.Wait()
+
+		if stageErr != nil {
+			return stageErr
+		}
+	}
+
+	return nil
+}
+
+// runStep waits for the dependencies of a step to complete, and executes it
+func (j *Job) runStep(p *Pipeline, stage Stage, step Step, num int, stepFolder string, results map[string]*stepResult, logMx *sync.Mutex) error {
+	for _, need := range step.Needs {
+		result := results[need]
+		<-result.done
+		if result.failed {
+			logMx.Lock()
+			defer logMx.Unlock()
+
+			now := time.Now()
+			j.addCompletedSection(Section{Name: stage.Name + " / " + step.Name, Started: now, Finished: now})
+			fmt.Fprintf(j.logFile, "[[microci-section]]%s / %s\n", stage.Name, step.Name)
+			fmt.Fprintf(j.logFile, "[[stderr]]step '%s' skipped, since step '%s' failed\n", step.Name, need)
+			return errStepSkipped
+		}
+	}
+
+	if j.ctx.Err() != nil {
+		return errExecCancelled
+	}
+
+	script := filepath.Join(p.folder, filepath.Clean(step.Script))
+	if step.Run != "" {
+		script = filepath.Join(stepFolder, fmt.Sprintf("%d.sh", num))
+		err := ioutil.WriteFile(script, []byte("#!/bin/sh\nset -e\n"+step.Run+"\n"), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	script, err := filepath.Abs(script)
+	if err != nil {
+		return err
+	}
+
+	timeout := step.Timeout
+	if timeout <= 0 {
+		timeout = j.Config.Jobs.MaxExecutionTime
+	}
+
+	// Buffer the output of the step, since other steps may be running at the same time
+	out, err := os.Create(filepath.Join(stepFolder, fmt.Sprintf("%d.log", num)))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	section := Section{
+		Name:    stage.Name + " / " + step.Name,
+		Started: time.Now(),
+	}
+	stepErr := j.execScript(script, timeout, out, false)
+	section.Finished = time.Now()
+
+	// Add the output to the job log
+	logMx.Lock()
+	defer logMx.Unlock()
+
+	j.addCompletedSection(section)
+	fmt.Fprintf(j.logFile, "[[microci-section]]%s\n", section.Name)
+	_, err = out.Seek(0, 0)
+	if err == nil {
+		_, err = io.Copy(j.logFile, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if stepErr != nil {
+		_, description := describeError(stepErr)
+		fmt.Fprintf(j.logFile, "[[stderr]]step '%s' failed: %s\n", step.Name, description)
+	}
+	return stepErr
+}
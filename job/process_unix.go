@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package job
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// process describes a running process, as read from /proc
+type process struct {
+	PID     int
+	Group   int
+	Zombie  bool
+	Command string
+}
+
+func (p process) String() string {
+	return fmt.Sprintf("%d (%s)", p.PID, p.Command)
+}
+
+// processes returns all processes on the system.
+// If /proc is not available, no processes are returned
+func processes() []process {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var list []process
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			// The process has already exited
+			continue
+		}
+
+		// The command name may contain spaces and parentheses, so we parse the fields after the last ')'
+		idx := bytes.LastIndexByte(stat, ')')
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[idx+1:]))
+		if len(fields) < 3 {
+			continue
+		}
+
+		p := process{PID: pid, Zombie: fields[0] == "Z"}
+		p.Group, _ = strconv.Atoi(fields[2])
+
+		cmdline, _ := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		p.Command = strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+		if p.Command == "" {
+			start := bytes.IndexByte(stat, '(')
+			if start >= 0 && start < idx {
+				p.Command = string(stat[start+1 : idx])
+			}
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+// setProcessGroup makes cmd start in a new process group,
+// so that all processes started by it can be signalled at once
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stopProcessGroup sends SIGTERM to all processes in a process group,
+// and SIGKILL to the processes that are still running after the grace period.
+// It returns the processes that had to be killed
+func stopProcessGroup(pgid int, grace time.Duration) ([]string, error) {
+	err := syscall.Kill(-pgid, syscall.SIGTERM)
+	if err == syscall.ESRCH {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	exited := waitFor(func() bool {
+		return syscall.Kill(-pgid, 0) == syscall.ESRCH
+	}, grace)
+	if exited {
+		return nil, nil
+	}
+
+	var killed []string
+	for _, p := range processes() {
+		if p.Group == pgid && !p.Zombie {
+			killed = append(killed, p.String())
+		}
+	}
+	if len(killed) == 0 {
+		killed = []string{fmt.Sprintf("process group %d", pgid)}
+	}
+
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil, nil
+	}
+	return killed, err
+}
@@ -0,0 +1,19 @@
+package job
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup is not supported on windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// stopProcessGroup kills the process, since process groups are not supported on windows
+func stopProcessGroup(pgid int, grace time.Duration) ([]string, error) {
+	p, err := os.FindProcess(pgid)
+	if err != nil {
+		return nil, nil
+	}
+	return nil, p.Kill()
+}
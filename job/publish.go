@@ -0,0 +1,228 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kkyr/fig"
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// PublishFile is the name of the manifest in the artifact folder, which lists the artifacts to publish to gitea
+const PublishFile = "publish.yaml"
+
+// publishManifest describes which artifacts a script wants to publish to gitea.
+// Artifacts are selected by their path in the artifact folder, which may contain wildcards
+type publishManifest struct {
+	// Artifacts attached to the release of the pushed tag. The release is created if it doesn't exist
+	Release []string `fig:"release"`
+	// Artifacts linked in a comment on the pull request
+	PullRequest []string `fig:"pull_request"`
+	// Text included in the pull request comment
+	Comment string `fig:"comment"`
+}
+
+// giteaRelease describes a release returned by the gitea API
+type giteaRelease struct {
+	ID     int64 `json:"id"`
+	Assets []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"assets"`
+}
+
+// giteaUser describes a user returned by the gitea API
+type giteaUser struct {
+	Login string `json:"login"`
+}
+
+// giteaComment describes a comment returned by the gitea API
+type giteaComment struct {
+	ID   int64     `json:"id"`
+	Body string    `json:"body"`
+	User giteaUser `json:"user"`
+}
+
+// matchArtifacts returns the artifacts matching any of patterns
+func matchArtifacts(artifacts []Artifact, patterns []string) []Artifact {
+	var list []Artifact
+	for _, a := range artifacts {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), a.Path); ok {
+				list = append(list, a)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// publishArtifacts publishes the artifacts listed in the manifest of the job to gitea.
+// Release assets are only published by successful jobs, while the pull request comment
+// also reports failures. Errors are written to the job log, and don't affect the job status
+func (j *Job) publishArtifacts(status JobStatus, description string) {
+	manifest := publishManifest{}
+	err := fig.Load(&manifest, fig.File(PublishFile), fig.Dirs(j.ArtifactFolder()))
+	if errors.Is(err, fig.ErrFileNotFound) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(j.logFile, "[[stderr]]Could not read %s: %v\n", PublishFile, err)
+		return
+	}
+
+	artifacts := j.ListArtifacts()
+	tag := strings.TrimPrefix(j.Event.Ref, "refs/tags/")
+	if len(manifest.Release) > 0 && j.Type == gitea.EventTypePush && tag != j.Event.Ref && status == StatusSuccess {
+		err = j.publishRelease(tag, matchArtifacts(artifacts, manifest.Release))
+		if err != nil {
+			log.Printf("Could not publish release assets for job %s: %v", j.ID, err)
+			fmt.Fprintf(j.logFile, "[[stderr]]Could not publish release assets: %v\n", err)
+		}
+	}
+
+	// The text is written by the code of the pull request, so it's only posted as microci if that code is trusted
+	if manifest.Comment != "" && j.IsForkPullRequest() && !j.Config.Jobs.RepoConfig.AllowForks {
+		fmt.Fprintf(j.logFile, "Not including the comment from %s, since it is not trusted for pull requests from forks\n", PublishFile)
+		manifest.Comment = ""
+	}
+
+	if (len(manifest.PullRequest) > 0 || manifest.Comment != "") && j.Type == gitea.EventTypePullRequest {
+		body := j.pullRequestComment(status, description, manifest.Comment, matchArtifacts(artifacts, manifest.PullRequest))
+		err = j.publishComment(body)
+		if err != nil {
+			log.Printf("Could not publish pull request comment for job %s: %v", j.ID, err)
+			fmt.Fprintf(j.logFile, "[[stderr]]Could not publish pull request comment: %v\n", err)
+		}
+	}
+}
+
+// publishRelease uploads artifacts as assets of the release of tag, and creates the release if needed.
+// Assets with the same name as an artifact are replaced, so that re-running a job updates the release
+func (j *Job) publishRelease(tag string, artifacts []Artifact) error {
+	repoPath := path.Join("repos", j.CommitRepo)
+
+	var release giteaRelease
+	err := GiteaRequest(j.API, http.MethodGet, path.Join(repoPath, "releases", "tags", tag), nil, &release)
+	if errors.Is(err, ErrNotFound) {
+		create := map[string]interface{}{"tag_name": tag, "name": tag}
+		err = GiteaRequest(j.API, http.MethodPost, path.Join(repoPath, "releases"), create, &release)
+	}
+	if err != nil {
+		return err
+	}
+
+	releasePath := path.Join(repoPath, "releases", fmt.Sprint(release.ID), "assets")
+	for _, a := range artifacts {
+		name := path.Base(a.Path)
+		for _, existing := range release.Assets {
+			if existing.Name != name {
+				continue
+			}
+			err = GiteaRequest(j.API, http.MethodDelete, path.Join(releasePath, fmt.Sprint(existing.ID)), nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = j.uploadAsset(releasePath+"?name="+url.QueryEscape(name), name, a)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(j.logFile, "Published %s to release %s\n", a.Path, tag)
+	}
+	return nil
+}
+
+// uploadAsset uploads an artifact as a release asset, streaming it as a multipart form
+func (j *Job) uploadAsset(apiPath string, name string, a Artifact) error {
+	f, err := os.Open(filepath.Join(j.ArtifactFolder(), filepath.FromSlash(a.Path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("attachment", name)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = GiteaRawRequest(j.API, http.MethodPost, apiPath, form.FormDataContentType(), pr, nil)
+	pr.Close()
+	return err
+}
+
+// commentMarker returns a marker included in the pull request comment of the job,
+// which is used to find the comment on later runs. Each context has its own comment
+func (j *Job) commentMarker() string {
+	return fmt.Sprintf("<!-- microci:%s -->", j.Context)
+}
+
+// pullRequestComment returns the body of the pull request comment, with links to artifacts
+func (j *Job) pullRequestComment(status JobStatus, description string, text string, artifacts []Artifact) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s\n", j.commentMarker())
+	name := "microci"
+	if j.Context != "" {
+		name += " (" + j.Context + ")"
+	}
+	fmt.Fprintf(b, "**%s**: [%s](%s) for %s - %s\n", name, status, j.TargetURL, j.CommitID, description)
+
+	if text != "" {
+		fmt.Fprintf(b, "\n%s\n", text)
+	}
+
+	if len(artifacts) > 0 {
+		fmt.Fprintf(b, "\n| Artifact | Size |\n|----------|------|\n")
+		for _, a := range artifacts {
+			fmt.Fprintf(b, "| [%s](%s/artifacts/%s) | %s |\n", a.Path, j.TargetURL, a.EscapedPath(), a.FormattedSize())
+		}
+	}
+	return b.String()
+}
+
+// publishComment updates the pull request comment of the job, or creates it if this is the first run.
+// Only comments posted by microci itself are updated, since anyone can post a comment containing the marker
+func (j *Job) publishComment(body string) error {
+	issuePath := path.Join("repos", j.CommitRepo, "issues")
+	commentsPath := path.Join(issuePath, fmt.Sprint(j.Event.PullRequest.Number), "comments")
+
+	var user giteaUser
+	err := GiteaRequest(j.API, http.MethodGet, "user", nil, &user)
+	if err != nil {
+		return err
+	}
+
+	var comments []giteaComment
+	err = GiteaRequest(j.API, http.MethodGet, commentsPath, nil, &comments)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range comments {
+		if c.User.Login == user.Login && strings.HasPrefix(c.Body, j.commentMarker()) {
+			update := map[string]string{"body": body}
+			return GiteaRequest(j.API, http.MethodPatch, path.Join(issuePath, "comments", fmt.Sprint(c.ID)), update, nil)
+		}
+	}
+
+	create := map[string]string{"body": body}
+	return GiteaRequest(j.API, http.MethodPost, commentsPath, create, nil)
+}
@@ -0,0 +1,93 @@
+package job
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kkyr/fig"
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// RepoConfigFile is the name of the configuration file that can be committed in a repository
+const RepoConfigFile = ".microci.yml"
+
+// RepoJob describes what to execute for a job, as configured in a repository.
+// Either a script or a list of stages should be specified
+type RepoJob struct {
+	// Script to execute, relative to the root of the repository
+	Script string  `fig:"script"`
+	Stages []Stage `fig:"stages"`
+}
+
+// RepoConfig is the configuration committed in a repository.
+// The settings for a specific context are used if available,
+// otherwise the top-level settings apply to all contexts
+type RepoConfig struct {
+	RepoJob  `fig:",squash"`
+	Contexts map[string]RepoJob `fig:"contexts"`
+}
+
+// IsForkPullRequest returns true if the job was triggered by a pull request from another repository
+func (j *Job) IsForkPullRequest() bool {
+	if j.Type != gitea.EventTypePullRequest {
+		return false
+	}
+	return j.Event.PullRequest.Head.Repo.FullName != j.Event.PullRequest.Base.Repo.FullName
+}
+
+// loadRepoConfig reads the configuration committed in the repository, if it exists and is trusted.
+// nil is returned if no configuration should be used
+func (j *Job) loadRepoConfig() (*RepoJob, error) {
+	if !j.Config.Jobs.RepoConfig.Enabled {
+		return nil, nil
+	}
+
+	gitFolder := filepath.Join(j.Folder, "git")
+	if !isFile(filepath.Join(gitFolder, RepoConfigFile)) {
+		return nil, nil
+	}
+
+	if j.IsForkPullRequest() && !j.Config.Jobs.RepoConfig.AllowForks {
+		fmt.Fprintf(j.logFile, "Ignoring %s, since it is not trusted for pull requests from forks\n", RepoConfigFile)
+		return nil, nil
+	}
+
+	cfg := &RepoConfig{}
+	err := fig.Load(cfg, fig.File(RepoConfigFile), fig.Dirs(gitFolder))
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s: %w", RepoConfigFile, err)
+	}
+
+	rj := cfg.RepoJob
+	if c, ok := cfg.Contexts[j.Context]; ok {
+		rj = c
+	}
+
+	if (rj.Script == "") == (len(rj.Stages) == 0) {
+		return nil, fmt.Errorf("%s must specify exactly one of 'script' and 'stages'", RepoConfigFile)
+	}
+	return &rj, nil
+}
+
+// runRepoConfig executes the script or pipeline configured in the repository
+func (j *Job) runRepoConfig(rj *RepoJob) error {
+	gitFolder := filepath.Join(j.Folder, "git")
+
+	if rj.Script != "" {
+		// Make sure the script is located within the repository
+		script, err := filepath.Abs(filepath.Join(gitFolder, filepath.Clean("/"+rj.Script)))
+		if err != nil {
+			return err
+		}
+
+		j.StartSection("Run " + filepath.Clean(rj.Script))
+		return j.ExecScript(script)
+	}
+
+	p := &Pipeline{Stages: rj.Stages, folder: gitFolder}
+	err := p.validate()
+	if err != nil {
+		return fmt.Errorf("invalid pipeline in %s: %w", RepoConfigFile, err)
+	}
+	return j.runPipeline(p)
+}
@@ -0,0 +1,436 @@
+//go:build linux
+// +build linux
+
+package job
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// SandboxInitName is the process name used when microci is started as the init process of a sandbox
+const SandboxInitName = "microci-sandbox-init"
+
+// SandboxExecutor executes scripts in new user, mount and PID namespaces.
+// All filesystems are read-only inside the sandbox, except for the job folder. The folders and files of microci,
+// such as the configuration file and the folders containing other jobs, are hidden.
+// TMPDIR is set to a folder inside the job folder. Scripts run as root inside the sandbox, which is mapped to the user running microci
+type SandboxExecutor struct {
+	// DisableNetwork runs the script in a new network namespace, which only has a loopback interface
+	DisableNetwork bool
+	Limits         config.Limits
+	CgroupBase     string
+
+	cgroup *cgroup
+}
+
+// Command returns a command that starts a new instance of microci in the sandbox,
+// which prepares the sandbox and then executes script
+func (e *SandboxExecutor) Command(j *Job, script string, dir string, env []string) (*exec.Cmd, error) {
+	jobFolder, err := filepath.Abs(j.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFolder := filepath.Join(jobFolder, "tmp")
+	err = os.MkdirAll(tmpFolder, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	e.cgroup, err = scriptCgroup(j, e.CgroupBase, e.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{SandboxInitName, "-folder=" + jobFolder}
+
+	// Scripts are started by microci as the same user, so anything readable by microci would be readable by them.
+	// The configuration contains credentials, the jobs folder contains the secrets of other jobs,
+	// and the cache folder contains the caches of other repositories
+	hidden := []string{j.Config.Jobs.Folder, j.Config.Scripts.Folder, j.Config.ResourceDir, j.Config.Cache.Folder, config.File}
+	for _, p := range hidden {
+		p, err = filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-hide="+p)
+	}
+
+	// Scripts located outside the job folder stay visible, but read-only
+	scriptDir, err := filepath.Abs(filepath.Dir(script))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(scriptDir+"/", jobFolder+"/") {
+		args = append(args, "-keep="+scriptDir)
+	}
+
+	if e.DisableNetwork {
+		args = append(args, "-no-network")
+	}
+	if e.cgroup != nil {
+		args = append(args, "-cgroup="+e.cgroup.path)
+	}
+	args = append(args, "--", script)
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if e.DisableNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: args,
+		Dir:  dir,
+		Env:  append(env, "TMPDIR="+tmpFolder),
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:  uintptr(flags),
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+			Pdeathsig:   syscall.SIGKILL,
+		},
+	}
+	return cmd, nil
+}
+
+// Stop sends SIGTERM to the init process of the sandbox, which forwards it to all processes in the sandbox.
+// If any processes are still running after the grace period, the init process is killed,
+// which makes the kernel kill all other processes in the sandbox
+func (e *SandboxExecutor) Stop(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", cmd.Process.Pid))
+	if err != nil {
+		// The sandbox has already exited
+		return nil, nil
+	}
+
+	running := func() []string {
+		var list []string
+		for _, p := range processes() {
+			ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", p.PID))
+			if err == nil && ns == namespace && !p.Zombie {
+				list = append(list, p.String())
+			}
+		}
+		return list
+	}
+
+	err = cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return nil, nil
+	}
+
+	if waitFor(func() bool { return len(running()) == 0 }, grace) {
+		return nil, nil
+	}
+	return running(), cmd.Process.Kill()
+}
+
+// Cleanup removes the cgroup of the sandbox.
+// The kernel kills all processes in the sandbox when the init process exits
+func (e *SandboxExecutor) Cleanup(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	if e.cgroup == nil {
+		return nil, nil
+	}
+	return nil, e.cgroup.remove()
+}
+
+// LimitExceeded checks if any process in the sandbox exceeded a limit
+func (e *SandboxExecutor) LimitExceeded(j *Job, cmd *exec.Cmd) string {
+	if e.cgroup == nil {
+		return ""
+	}
+	return e.cgroup.exceeded(j.logFile)
+}
+
+// pathList is a flag that can be given multiple times
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(p string) error {
+	*l = append(*l, p)
+	return nil
+}
+
+// SandboxInit is called when microci is started as the init process of a sandbox.
+// It prepares the mounts and network of the sandbox, executes the script and exits with its exit code
+func SandboxInit(args []string) {
+	flags := flag.NewFlagSet(SandboxInitName, flag.ExitOnError)
+	folder := flags.String("folder", "", "job folder, which will be writable in the sandbox")
+	noNetwork := flags.Bool("no-network", false, "set if the sandbox has its own network namespace")
+	cgroupPath := flags.String("cgroup", "", "cgroup to execute the script in")
+	var hide, keep pathList
+	flags.Var(&hide, "hide", "folder or file that is hidden in the sandbox")
+	flags.Var(&keep, "keep", "folder that stays visible, but read-only, even if it is inside a hidden folder")
+	_ = flags.Parse(args)
+
+	if *folder == "" || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "%s: job folder and script must be specified\n", SandboxInitName)
+		os.Exit(1)
+	}
+
+	// The cgroup must be joined before the cgroup filesystem is made read-only
+	if *cgroupPath != "" {
+		err := joinCgroup(*cgroupPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set up sandbox: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	err := setupSandbox(*folder, hide, keep, *noNetwork)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up sandbox: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(runSandboxed(flags.Args()))
+}
+
+// setupSandbox hides the paths in hide, makes every mount except the job folder read-only, and mounts /proc.
+// The job folder and the folders in keep stay visible, even if they are inside a hidden folder
+func setupSandbox(folder string, hide, keep []string, noNetwork bool) error {
+	// The working directory may be hidden below, so we need to change into it again afterwards
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// Make sure that none of our changes propagate back to the host
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("cannot make mounts private: %w", err)
+	}
+
+	// /proc is mounted first, since the folders that stay visible are mounted from /proc/self/fd
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("cannot mount /proc: %w", err)
+	}
+
+	// The folders that stay visible are opened before anything is hidden, so that they can be mounted again afterwards
+	visible := append([]string{folder}, keep...)
+	fds := make([]int, len(visible))
+	for k, p := range visible {
+		fds[k], err = syscall.Open(p, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %w", p, err)
+		}
+		defer syscall.Close(fds[k])
+	}
+
+	for _, p := range hide {
+		err = hidePath(p)
+		if err != nil {
+			return fmt.Errorf("cannot hide %s: %w", p, err)
+		}
+	}
+
+	// The job folder is bound as a separate mount, which stays writable
+	for k, p := range visible {
+		err = os.MkdirAll(p, 0755)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount(fmt.Sprintf("/proc/self/fd/%d", fds[k]), p, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("cannot mount %s: %w", p, err)
+		}
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		if m == folder || strings.HasPrefix(m, folder+"/") ||
+			m == "/proc" || strings.HasPrefix(m, "/proc/") {
+			continue
+		}
+
+		err = remountReadOnly(m)
+		if err != nil {
+			return fmt.Errorf("cannot make %s read-only: %w", m, err)
+		}
+	}
+
+	err = os.Chdir(dir)
+	if err != nil {
+		return err
+	}
+
+	if noNetwork {
+		err = enableLoopback()
+		if err != nil {
+			return fmt.Errorf("cannot enable loopback interface: %w", err)
+		}
+	}
+	return nil
+}
+
+// hidePath hides the contents of a folder behind an empty tmpfs, or a file behind /dev/null.
+// The tmpfs is made read-only together with all other mounts
+func hidePath(p string) error {
+	if p == "/" {
+		return nil
+	}
+
+	st, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		// Already hidden by another path
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if st.IsDir() {
+		return syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "size=1m,mode=0755")
+	}
+	return syscall.Mount("/dev/null", p, "", syscall.MS_BIND, "")
+}
+
+// mountPoints returns all mount points in the current mount namespace
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPoint(fields[4]))
+	}
+	return mounts, lines.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes (e.g. "\040" for space) used in /proc/self/mountinfo
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// remountReadOnly makes the mount at path read-only.
+// Flags such as nosuid and noexec cannot be cleared inside a user namespace, so they are kept
+func remountReadOnly(path string) error {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if os.IsNotExist(err) {
+		// Mount point is hidden by another mount
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The flags returned by statfs have the same values as the corresponding mount flags
+	keep := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | (uintptr(st.Flags) & keep)
+	return syscall.Mount("", path, "", flags, "")
+}
+
+// enableLoopback brings up the loopback interface of a new network namespace
+func enableLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, with the union reduced to the flags we need
+	var req struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}
+	copy(req.Name[:], "lo")
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errno
+	}
+	req.Flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runSandboxed executes the script as a child of the init process, forwards signals to it,
+// and reaps any orphaned processes until the script exits
+func runSandboxed(args []string) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	err := cmd.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not execute %s: %v\n", args[0], err)
+		return 1
+	}
+
+	// Signals are forwarded to all processes in the sandbox
+	go func() {
+		for sig := range signals {
+			_ = syscall.Kill(-1, sig.(syscall.Signal))
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not wait for %s: %v\n", args[0], err)
+			return 1
+		}
+
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
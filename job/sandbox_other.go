@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+package job
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+)
+
+// SandboxInitName is the process name used when microci is started as the init process of a sandbox
+const SandboxInitName = "microci-sandbox-init"
+
+// SandboxExecutor is only supported on linux
+type SandboxExecutor struct {
+	DisableNetwork bool
+	Limits         config.Limits
+	CgroupBase     string
+}
+
+// Command always returns an error, since namespaces are only available on linux
+func (e *SandboxExecutor) Command(j *Job, script string, dir string, env []string) (*exec.Cmd, error) {
+	return nil, errors.New("sandbox executor is only supported on linux")
+}
+
+// Stop kills the script
+func (e *SandboxExecutor) Stop(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	return nil, cmd.Process.Kill()
+}
+
+// Cleanup does nothing
+func (e *SandboxExecutor) Cleanup(j *Job, cmd *exec.Cmd, grace time.Duration) ([]string, error) {
+	return nil, nil
+}
+
+// LimitExceeded does nothing
+func (e *SandboxExecutor) LimitExceeded(j *Job, cmd *exec.Cmd) string {
+	return ""
+}
+
+// SandboxInit is never used on this platform
+func SandboxInit(args []string) {
+	fmt.Fprintf(os.Stderr, "%s: sandbox executor is only supported on linux\n", SandboxInitName)
+	os.Exit(1)
+}
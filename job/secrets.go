@@ -0,0 +1,97 @@
+package job
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Secret is a decrypted secret, which is made available to the scripts of a job
+type Secret struct {
+	Name  string
+	Value string
+	// If set, the value is written to a file, and the variable contains the path to the file
+	File bool
+}
+
+// secretsFolder returns the folder containing secrets that are stored in files
+func (j *Job) secretsFolder() (string, error) {
+	return filepath.Abs(filepath.Join(j.Folder, "secrets"))
+}
+
+// secretVariables returns the environment variables for all secrets of the job,
+// and writes the secrets that should be stored in files
+func (j *Job) secretVariables() ([]string, error) {
+	var variables []string
+	for _, s := range j.Secrets {
+		if !s.File {
+			variables = append(variables, s.Name+"="+s.Value)
+			continue
+		}
+
+		folder, err := j.secretsFolder()
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(folder, 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		p := filepath.Join(folder, s.Name)
+		err = ioutil.WriteFile(p, []byte(s.Value), 0600)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, s.Name+"="+p)
+	}
+	return variables, nil
+}
+
+// removeSecretFiles removes the secrets written by secretVariables
+func (j *Job) removeSecretFiles() error {
+	folder, err := j.secretsFolder()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(folder)
+}
+
+// secretMasker returns a replacer which replaces all secret values with "***",
+// or nil if the job has no secrets
+func (j *Job) secretMasker() *strings.Replacer {
+	var values []string
+	for _, s := range j.Secrets {
+		values = append(values, s.Value)
+
+		// Output is masked line by line, so every line of multi-line secrets is masked separately
+		for _, line := range strings.Split(s.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && line != s.Value {
+				values = append(values, line)
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Longer values are replaced first, so that a secret containing another secret is masked completely
+	sort.Slice(values, func(a, b int) bool {
+		return len(values[a]) > len(values[b])
+	})
+
+	var pairs []string
+	for _, v := range values {
+		if v != "" {
+			pairs = append(pairs, v, "***")
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return strings.NewReplacer(pairs...)
+}
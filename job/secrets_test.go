@@ -0,0 +1,49 @@
+package job
+
+import "testing"
+
+func TestSecretMasker(t *testing.T) {
+	key := "-----BEGIN KEY-----\n  abcdef\n-----END KEY-----\n"
+
+	tests := []struct {
+		name    string
+		secrets []Secret
+		line    string
+		want    string
+	}{
+		{name: "secret", secrets: []Secret{{Name: "TOKEN", Value: "hunter2"}}, line: "token=hunter2, again hunter2", want: "token=***, again ***"},
+		{name: "no secret in line", secrets: []Secret{{Name: "TOKEN", Value: "hunter2"}}, line: "hello", want: "hello"},
+		{name: "secret in file", secrets: []Secret{{Name: "TOKEN", Value: "hunter2", File: true}}, line: "hunter2", want: "***"},
+		{
+			name:    "secret containing another secret",
+			secrets: []Secret{{Name: "SHORT", Value: "abc"}, {Name: "LONG", Value: "abcdef"}},
+			line:    "abcdef abc",
+			want:    "*** ***",
+		},
+		{name: "line of multi-line secret", secrets: []Secret{{Name: "KEY", Value: key}}, line: "    abcdef", want: "    ***"},
+		{name: "first line of multi-line secret", secrets: []Secret{{Name: "KEY", Value: key}}, line: "-----BEGIN KEY-----", want: "***"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Job{Secrets: tt.secrets}
+			masker := j.secretMasker()
+			if masker == nil {
+				t.Fatal("secretMasker returned nil")
+			}
+			got := masker.Replace(tt.line)
+			if got != tt.want {
+				t.Errorf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretMaskerWithoutSecrets(t *testing.T) {
+	for _, secrets := range [][]Secret{nil, {{Name: "EMPTY", Value: ""}}} {
+		j := &Job{Secrets: secrets}
+		if j.secretMasker() != nil {
+			t.Errorf("secretMasker returned a replacer for secrets %v", secrets)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package job
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+)
+
+// VariablesVersion is the version of the set of MICROCI_* variables.
+// It's increased whenever a variable is removed, or its meaning changes
+const VariablesVersion = 1
+
+// changedFilesName is the name of the file in the job folder listing the files changed by the commits of the job
+const changedFilesName = "changed-files.txt"
+
+// Variable describes an environment variable that is available to scripts
+type Variable struct {
+	Name        string
+	Description string
+	value       func(j *Job) string
+}
+
+// Variables lists the MICROCI_* variables available to scripts.
+// These are the stable interface for scripts, and are documented at /help/variables and in README.md
+//
+//go:generate go run gen_variables.go ../README.md
+var Variables = []Variable{
+	{"MICROCI_VARIABLES_VERSION", "Version of this set of variables, currently " + strconv.Itoa(VariablesVersion),
+		func(j *Job) string { return strconv.Itoa(VariablesVersion) }},
+	{"MICROCI_JOB_ID", "ID of the job",
+		func(j *Job) string { return j.ID }},
+	{"MICROCI_JOB_URL", "URL of the job page",
+		func(j *Job) string { return j.TargetURL }},
+	{"MICROCI_QUEUE", "Name of the queue the job belongs to, e.g. the branch, pull request or schedule",
+		func(j *Job) string { return j.QueueName }},
+	{"MICROCI_CONTEXT", "Context the job reports its status with",
+		func(j *Job) string { return j.Context }},
+	{"MICROCI_EVENT", "Type of event that triggered the job, 'push' or 'pull_request'",
+		func(j *Job) string {
+			// Type.String() is meant for display, e.g. "pull request", so the values are mapped explicitly
+			switch j.Type {
+			case gitea.EventTypePush:
+				return "push"
+			case gitea.EventTypePullRequest:
+				return "pull_request"
+			}
+			return ""
+		}},
+	{"MICROCI_COMMIT_SHA", "Commit being tested",
+		func(j *Job) string { return j.CommitID }},
+	{"MICROCI_REF", "Full name of the pushed ref, e.g. 'refs/heads/main' or 'refs/tags/v1.0'. Empty for pull requests",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush {
+				return j.Event.Ref
+			}
+			return ""
+		}},
+	{"MICROCI_TAG", "Name of the pushed tag. Empty if the job was not triggered by a tag",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush && strings.HasPrefix(j.Event.Ref, "refs/tags/") {
+				return strings.TrimPrefix(j.Event.Ref, "refs/tags/")
+			}
+			return ""
+		}},
+	{"MICROCI_HEAD_REF", "Branch containing the changes, i.e. the pushed branch or the source branch of a pull request",
+		func(j *Job) string { return j.headRef() }},
+	{"MICROCI_HEAD_SHA", "Last commit of the head branch",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush {
+				return j.Event.After
+			}
+			return j.Event.PullRequest.Head.SHA
+		}},
+	{"MICROCI_BASE_REF", "Target branch of a pull request. Empty for pushes",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush {
+				return ""
+			}
+			return j.Event.PullRequest.Base.Ref
+		}},
+	{"MICROCI_BASE_SHA", "Last commit of the target branch of a pull request, or the previous commit of the pushed branch",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush {
+				return j.Event.Before
+			}
+			return j.Event.PullRequest.Base.SHA
+		}},
+	{"MICROCI_PR_NUMBER", "Number of the pull request. Empty for pushes",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush || j.Event.PullRequest.Number == 0 {
+				return ""
+			}
+			return strconv.Itoa(j.Event.PullRequest.Number)
+		}},
+	{"MICROCI_REPO", "Full name of the repository, e.g. 'owner/name'",
+		func(j *Job) string { return j.CommitRepo }},
+	{"MICROCI_REPO_OWNER", "Owner of the repository",
+		func(j *Job) string { return j.Event.Repository.Owner.Login }},
+	{"MICROCI_REPO_NAME", "Name of the repository, without the owner",
+		func(j *Job) string { return j.Event.Repository.Name }},
+	{"MICROCI_CLONE_URL", "URL used to clone the repository",
+		func(j *Job) string { return j.Event.Repository.CloneURL }},
+	{"MICROCI_AUTHOR", "Login of the user that pushed the changes or opened the pull request",
+		func(j *Job) string {
+			if j.Type == gitea.EventTypePush {
+				return j.Event.Pusher.Login
+			}
+			return j.Event.PullRequest.User.Login
+		}},
+	{"MICROCI_CHANGED_FILES", "Path to a file listing the files changed by the pushed commits or the pull request, one per line. " +
+		"Empty if the list could not be created",
+		func(j *Job) string {
+			p, err := filepath.Abs(filepath.Join(j.Folder, changedFilesName))
+			if err != nil || !isFile(p) {
+				return ""
+			}
+			return p
+		}},
+	{"MICROCI_SCRIPT", "Path to the script being executed for the job",
+		func(j *Job) string { return j.Script }},
+	{"MICROCI_ARTIFACT_DIR", "Folder where artifacts should be stored, same as ARTIFACT_DIR",
+		func(j *Job) string {
+			p, _ := filepath.Abs(filepath.Join(j.Folder, "artifacts"))
+			return p
+		}},
+	{"MICROCI_CACHE_DIR", "Folder containing the caches of the job, one folder per cache. " +
+		"Each cache is also available in MICROCI_CACHE_<NAME>, e.g. MICROCI_CACHE_GO_MODULES for the cache 'go-modules'",
+		func(j *Job) string {
+			p, _ := filepath.Abs(filepath.Join(j.Folder, "caches"))
+			return p
+		}},
+}
+
+// LegacyVariables returns the names of the variables created from the fields of the webhook event.
+// These are kept for existing scripts, but are not guaranteed to be stable between versions of gitea
+func LegacyVariables() []string {
+	var names []string
+	for _, v := range exportVar("", gitea.Event{}) {
+		names = append(names, strings.SplitN(v, "=", 2)[0])
+	}
+	return append(names, "ARTIFACT_DIR")
+}
+
+// headRef returns the pushed branch, or the source branch of a pull request
+func (j *Job) headRef() string {
+	if j.Type == gitea.EventTypePush {
+		if strings.HasPrefix(j.Event.Ref, "refs/heads/") {
+			return strings.TrimPrefix(j.Event.Ref, "refs/heads/")
+		}
+		return ""
+	}
+	return j.Event.PullRequest.Head.Ref
+}
+
+// variables returns all MICROCI_* variables for the job, including the folders of its caches
+func (j *Job) variables() []string {
+	list := make([]string, 0, len(Variables))
+	for _, v := range Variables {
+		list = append(list, v.Name+"="+v.value(j))
+	}
+	return append(list, j.cacheVariables()...)
+}
+
+// isNullCommit returns true if sha is empty or consists of zeros, which gitea uses for new branches
+func isNullCommit(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
+
+// writeChangedFiles lists the files changed by the job in the job folder, using the checked out git repository
+func (j *Job) writeChangedFiles() {
+	base, head := j.Event.Before, j.Event.After
+	if j.Type != gitea.EventTypePush {
+		base, head = j.Event.PullRequest.Base.SHA, j.Event.PullRequest.Head.SHA
+	}
+	if isNullCommit(head) {
+		head = j.CommitID
+	}
+
+	var args []string
+	if isNullCommit(base) || isNullCommit(head) {
+		// New branches only list the changes in the last commit
+		args = []string{"show", "--pretty=format:", "--name-only", "HEAD"}
+	} else {
+		args = []string{"diff", "--name-only", base + "..." + head}
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = filepath.Join(j.Folder, "git")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Could not list changed files for job %s: %v: %s", j.ID, err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	out = bytes.TrimLeft(out, "\n")
+	err = ioutil.WriteFile(filepath.Join(j.Folder, changedFilesName), out, 0644)
+	if err != nil {
+		log.Printf("Could not write changed files for job %s: %v", j.ID, err)
+		_ = os.Remove(filepath.Join(j.Folder, changedFilesName))
+	}
+}
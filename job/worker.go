@@ -7,8 +7,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-
-	gitea "github.com/yzzyx/gitea-webhook"
 )
 
 // Worker receives webhook events and processes jobs
@@ -25,11 +23,53 @@ func NewWorker(ch <-chan *Job) {
 	}
 }
 
+// describeError returns the job status and description to report for an error returned by a script
+func describeError(err error) (JobStatus, string) {
+	exit := &exec.ExitError{}
+	limit := &LimitError{}
+	checkout := &CheckoutError{}
+	jobStatus := StatusError
+	description := err.Error()
+	if errors.As(err, &limit) {
+		jobStatus = StatusKilled
+	} else if errors.As(err, &checkout) {
+		description = "checkout failed"
+	} else if errors.As(err, &exit) {
+		description = fmt.Sprintf("script failed with code %d", exit.ExitCode())
+	} else if errors.Is(err, errExecCancelled) {
+		description = "job cancelled"
+		jobStatus = StatusCancelled
+	} else if errors.Is(err, errExecTimedOut) {
+		description = "job execution timed out"
+		jobStatus = StatusTimeout
+	}
+
+	// Include the name of the failing step, if the job is a pipeline
+	stepErr := &StepError{}
+	if errors.As(err, &stepErr) && errors.Is(err, errStepSkipped) {
+		description = stepErr.Error()
+	} else if errors.As(err, &stepErr) {
+		description = fmt.Sprintf("step '%s': %s", stepErr.Step, description)
+	}
+	return jobStatus, description
+}
+
 // ProcessJob tries to execute the script specified in job,
 // and updates the commit status in gitea with the Result
 func (w *Worker) ProcessJob(j *Job) {
 	// Cleanup when we're done
 	defer j.logFile.Close()
+	defer func() {
+		err := j.removeSecretFiles()
+		if err != nil {
+			log.Printf("Could not remove secrets for job %s: %v", j.ID, err)
+		}
+	}()
+
+	// The job might have been cancelled while it was waiting in the queue
+	if !j.start("In progress...") {
+		return
+	}
 
 	log.Printf("Processing job %s", j.ID)
 
@@ -38,20 +78,10 @@ func (w *Worker) ProcessJob(j *Job) {
 			return
 		}
 
-		exit := &exec.ExitError{}
 		// If our script retuned an error, we should inform gitea
-		jobStatus := StatusError
-		description := err.Error()
-		if errors.As(err, &exit) {
-			description = fmt.Sprintf("script failed with code %d", exit.ExitCode())
-		} else if errors.Is(err, errExecCancelled) {
-			description = "job cancelled"
-			jobStatus = StatusCancelled
-		} else if errors.Is(err, errExecTimedOut) {
-			description = "job execution timed out"
-			jobStatus = StatusTimeout
-		}
+		jobStatus, description := describeError(err)
 		log.Printf("Job %s failed: %s", j.ID, description)
+		j.publishArtifacts(jobStatus, description)
 		j.SetStatus(jobStatus, description)
 		err = j.Save()
 		if err != nil {
@@ -60,44 +90,90 @@ func (w *Worker) ProcessJob(j *Job) {
 
 	}
 
-	j.SetStatus(StatusExecuting, "In progress...")
-
-	// Run preparation scripts
-	prepareScript := "prepare-pr.sh"
-	if j.Type == gitea.EventTypePush {
-		prepareScript = "prepare-push.sh"
+	// Check out the repository, either with git directly or by running a preparation script
+	j.StartSection("Prepare git branch")
+	var script string
+	var err error
+	if j.Settings.Checkout == "script" {
+		script, err = j.checkoutScript()
+		if err == nil {
+			err = j.ExecScript(script)
+		}
+	} else {
+		err = j.checkout()
 	}
-
-	script, err := filepath.Abs(filepath.Join(j.Config.ResourceDir, "scripts", prepareScript))
 	if err != nil {
 		handleError(err)
 		return
 	}
+	j.writeChangedFiles()
+
+	if len(j.Settings.Caches) > 0 {
+		j.StartSection("Restore caches")
+		j.restoreCaches()
+	}
 
-	fmt.Fprintf(j.logFile, "[[microci-section]]Prepare git branch\n")
-	err = j.ExecScript(script)
+	// Configuration committed in the repository takes precedence over server-side scripts
+	repoJob, err := j.loadRepoConfig()
 	if err != nil {
 		handleError(err)
 		return
 	}
 
-	// Run actual text-script
-	trimmedPath := strings.TrimPrefix(strings.TrimPrefix(j.Script, j.Config.Scripts.Folder), "/")
-	fmt.Fprintf(j.logFile, "[[microci-section]]Run %s\n", trimmedPath)
-	script, err = filepath.Abs(j.Script)
-	if err != nil {
-		handleError(err)
+	if repoJob == nil && j.Script == "" {
+		// Nothing has been reported to gitea for the job, and nothing should be, since the repository isn't built
+		log.Printf("Skipping job %s: no script or repository configuration found", j.ID)
+		j.SetStatus(StatusSkipped, "no script or repository configuration found")
+		err = j.Save()
+		if err != nil {
+			log.Printf("Could not save job status: %v", err)
+		}
 		return
 	}
 
-	err = j.ExecScript(script)
+	if repoJob != nil {
+		j.setRepoConfigFound()
+		err = j.runRepoConfig(repoJob)
+	} else {
+		// Run actual text-script
+		trimmedPath := strings.TrimPrefix(strings.TrimPrefix(j.Script, j.Config.Scripts.Folder), "/")
+		script, err = filepath.Abs(j.Script)
+		if err != nil {
+			handleError(err)
+			return
+		}
+
+		// Pipelines add one section per step
+		if IsPipeline(script) {
+			err = j.RunPipeline(script)
+		} else {
+			j.StartSection("Run " + trimmedPath)
+			err = j.ExecScript(script)
+		}
+	}
+
+	// Artifacts are recorded for failed jobs too, since they may help explain the failure
+	if artifactErr := j.recordArtifacts(); artifactErr != nil && err == nil {
+		err = artifactErr
+	}
 	if err != nil {
 		handleError(err)
 		return
 	}
 
+	// Caches are only saved by successful jobs, so that a failed job can't leave a broken cache behind
+	if len(j.Caches) > 0 {
+		j.StartSection("Save caches")
+		j.saveCaches()
+	}
+
 	log.Printf("Job %s completed successfully!", j.ID)
-	j.SetStatus(StatusSuccess, "Job completed successfully!")
+	description := "Job completed successfully!"
+	if len(j.allowedFailures) > 0 {
+		description = fmt.Sprintf("Job completed, but allowed steps failed: %s", strings.Join(j.allowedFailures, ", "))
+	}
+	j.publishArtifacts(StatusSuccess, description)
+	j.SetStatus(StatusSuccess, description)
 	err = j.Save()
 	if err != nil {
 		log.Printf("Could not save job status: %v", err)
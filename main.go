@@ -15,6 +15,7 @@ import (
 	"github.com/kkyr/fig"
 	gitea "github.com/yzzyx/gitea-webhook"
 	"github.com/yzzyx/microci/config"
+	"github.com/yzzyx/microci/job"
 )
 
 // DefaultResourceDir is used to locate resources such as preparation-scripts, templates and css files
@@ -39,6 +40,15 @@ func isDir(p string) bool {
 }
 
 func main() {
+	// The sandbox executor starts scripts through microci itself, which then sets up the sandbox
+	if os.Args[0] == job.SandboxInitName {
+		job.SandboxInit(os.Args[1:])
+	}
+	// Scripts with resource limits are started through microci, which moves them to their cgroup
+	if os.Args[0] == job.CgroupExecName {
+		job.CgroupExec(os.Args[1:])
+	}
+
 	ctx := context.Background()
 
 	// trap Ctrl+C and call cancel on the context
@@ -57,9 +67,10 @@ func main() {
 		}
 	}()
 
+	configFile := config.File
 	config := config.Config{}
 	err := fig.Load(&config,
-		fig.File("config.yaml"),
+		fig.File(configFile),
 		fig.UseEnv("MICROCI"),
 		fig.Dirs("."))
 
@@ -68,6 +79,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Secrets are managed from the command line, e.g. 'microci secret set owner/repo NAME'
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		err = secretCommand(&config, os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if config.Gitea.Username == "" && config.Gitea.Token == "" {
 		fmt.Fprintf(os.Stderr, "One of 'gitea.username' or 'gitea.token' must be specified in config\n")
 		os.Exit(1)
@@ -95,6 +116,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	go manager.RunCollector(ctx)
+	go manager.RunMirrorMaintenance(ctx)
+	go manager.RunScheduler(ctx)
+
 	view, err := NewViewHandler(&config, manager)
 	if err != nil {
 		log.Printf("Cannot initialize viewhandler: %+v", err)
@@ -106,9 +131,35 @@ func main() {
 
 	// WebhookEvent will be called if a request to /webhook/gitea has been successfully validated
 	router.Handle("/webhook/gitea", gitea.Handler(config.Gitea.SecretKey, manager.WebhookEvent))
+	router.Get("/projects", ViewWrapper(view.GetProjects))
+	router.Get("/projects/{owner}/{name}", ViewWrapper(view.GetProject))
+	router.Get("/help/variables", ViewWrapper(view.GetVariables))
+	router.Get("/jobs/active", ViewWrapper(view.GetActiveJobs))
+	router.Get("/jobs/active/events", ViewWrapper(view.GetActiveJobEvents))
 	router.Get("/job/{id}", ViewWrapper(view.GetJob))
 	router.Get("/job/{id}/cancel", ViewWrapper(view.CancelJob))
-	router.Get("/job/{id}/artifacts/{name}", ViewWrapper(view.GetArtifact))
+	router.Get("/job/{id}/artifacts.zip", ViewWrapper(view.GetArtifactArchive))
+	router.Get("/job/{id}/artifacts.tar.gz", ViewWrapper(view.GetArtifactArchive))
+	router.Get("/job/{id}/artifacts/*", ViewWrapper(view.GetArtifact))
+	// Manually triggering and re-running jobs requires authentication
+	adminAuth := middleware.BasicAuth("microci", map[string]string{config.Server.Admin.Username: config.Server.Admin.Password})
+	if config.Server.Admin.Username != "" {
+		router.With(adminAuth).Get("/trigger", ViewWrapper(view.GetTrigger))
+		router.With(adminAuth).Post("/trigger", ViewWrapper(view.PostTrigger))
+		router.With(adminAuth).Post("/job/{id}/rerun", ViewWrapper(view.RerunJob))
+	}
+
+	router.Route("/api/v1", func(r chi.Router) {
+		r.Get("/repos", ViewWrapper(view.APIGetRepositories))
+		r.Get("/repos/{owner}/{name}", ViewWrapper(view.APIGetRepository))
+		r.Get("/jobs/active", ViewWrapper(view.APIGetActiveJobs))
+		r.Get("/jobs/{id}", ViewWrapper(view.APIGetJob))
+		r.Post("/jobs/{id}/cancel", ViewWrapper(view.APICancelJob))
+		if config.Server.Admin.Username != "" {
+			r.With(adminAuth).Post("/jobs", ViewWrapper(view.APITriggerJob))
+			r.With(adminAuth).Post("/jobs/{id}/rerun", ViewWrapper(view.APIRerunJob))
+		}
+	})
 	router.Mount("/css", http.StripPrefix("/css", http.FileServer(http.Dir(filepath.Join(config.ResourceDir, "static", "css")))))
 	router.Mount("/js", http.StripPrefix("/js", http.FileServer(http.Dir(filepath.Join(config.ResourceDir, "static", "js")))))
 
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -16,6 +18,7 @@ import (
 	gitea "github.com/yzzyx/gitea-webhook"
 	"github.com/yzzyx/microci/config"
 	"github.com/yzzyx/microci/job"
+	"github.com/yzzyx/microci/secrets"
 )
 
 // Manager keeps track of all CI workers
@@ -24,7 +27,9 @@ type Manager struct {
 	cfg *config.Config
 	url *url.URL // URL of microci server
 
-	workerCh chan *job.Job
+	workerCh  chan *job.Job
+	pending   *pendingQueue
+	secretKey []byte // Key used to decrypt secrets
 
 	repos      []*Repository
 	reposMutex *sync.Mutex
@@ -58,16 +63,55 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 		return nil, fmt.Errorf("invalid number of workers (%d), must be atleast one", cfg.Jobs.Workers)
 	}
 
+	if cfg.Jobs.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size (%d), must not be negative", cfg.Jobs.QueueSize)
+	}
+
+	m.pending, err = newPendingQueue(cfg.Jobs.QueueSize, cfg.Jobs.QueueOverflow)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Secrets.Key != "" {
+		m.secretKey, err = secrets.ParseKey(cfg.Secrets.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Jobs.Cgroup != "" {
+		err = job.SetupCgroup(cfg.Jobs.Cgroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Start workers
 	for i := 0; i < cfg.Jobs.Workers; i++ {
 		go job.NewWorker(m.workerCh)
 	}
+	go m.dispatch()
 
 	return m, nil
 }
 
+// dispatch hands pending jobs over to workers as soon as one is available
+func (m *Manager) dispatch() {
+	defer close(m.workerCh)
+
+	for {
+		j := m.pending.Next()
+		if j == nil {
+			return
+		}
+
+		m.workerCh <- j
+		m.pending.Remove(j)
+	}
+}
+
 func (m *Manager) Shutdown() {
-	close(m.workerCh)
+	m.pending.Close()
 
 	m.jobsMutex.Lock()
 	defer m.jobsMutex.Unlock()
@@ -89,60 +133,146 @@ func (m *Manager) GetRepo(name string) *Repository {
 	}
 
 	repo := NewRepository(name)
+	repo.Mirror = job.NewMirror(filepath.Join(m.cfg.Cache.Folder, "git", path.Clean(name)+".git"), m.api, m.cfg.Gitea.URL)
 	m.repos = append(m.repos, repo)
 	return repo
 }
 
-// WebhookEvent is called when a webhook has successfully been authenticated
-func (m *Manager) WebhookEvent(typ gitea.EventType, ev gitea.Event, responseWriter http.ResponseWriter, r *http.Request) {
-	var scriptName string
-	var branchName string
+// GetRepos returns all known repositories, sorted by name
+func (m *Manager) GetRepos() []*Repository {
+	m.reposMutex.Lock()
+	defer m.reposMutex.Unlock()
 
-	job := &job.Job{
-		Type:      typ,
-		Event:     ev,
-		API:       m.api,
-		Config:    m.cfg,
-		Context:   m.cfg.Jobs.DefaultContext,
-		TargetURL: m.url.String(),
-	}
+	repos := make([]*Repository, len(m.repos))
+	copy(repos, m.repos)
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Name < repos[j].Name
+	})
+	return repos
+}
 
-	// Default script is 'default.sh'.
-	// If a script is specified in the webhook URL as a parameter,
-	// we will try to use that instead.
-	scriptName = "default.sh"
-	if s := r.URL.Query().Get("script"); s != "" {
-		scriptName = s
-	}
+// FindRepo returns the repository with the supplied name, or nil if it is not known
+func (m *Manager) FindRepo(name string) *Repository {
+	m.reposMutex.Lock()
+	defer m.reposMutex.Unlock()
 
-	// Set the context to report back to gitea
-	if s := r.URL.Query().Get("context"); s != "" {
-		job.Context = s
+	for k := range m.repos {
+		if m.repos[k].Name == name {
+			return m.repos[k]
+		}
 	}
+	return nil
+}
+
+// WebhookEvent is called when a webhook has successfully been authenticated
+func (m *Manager) WebhookEvent(typ gitea.EventType, ev gitea.Event, responseWriter http.ResponseWriter, r *http.Request) {
+	var branchName string
+	var queueName string
+	var commitRepo string
+	var commitID string
 
 	switch typ {
 	case gitea.EventTypePush:
 		branchName = strings.TrimPrefix(ev.Ref, "refs/heads/")
-		job.QueueName = branchName
-		job.CommitRepo = ev.Repository.FullName
-		job.CommitID = ev.After
+		queueName = branchName
+		commitRepo = ev.Repository.FullName
+		commitID = ev.After
 	case gitea.EventTypePullRequest:
 		branchName = ev.PullRequest.Base.Ref
-		job.QueueName = fmt.Sprintf("PR #%d", ev.PullRequest.ID)
-		job.CommitRepo = ev.PullRequest.Base.Repo.FullName
-		job.CommitID = ev.PullRequest.Head.SHA
+		queueName = fmt.Sprintf("PR #%d", ev.PullRequest.ID)
+		commitRepo = ev.PullRequest.Base.Repo.FullName
+		commitID = ev.PullRequest.Head.SHA
 	default:
 		return
 	}
 
-	repoPath := filepath.Join(m.cfg.Scripts.Folder, path.Clean(job.CommitRepo))
+	repoPath := filepath.Join(m.cfg.Scripts.Folder, path.Clean(commitRepo))
 	if !isDir(repoPath) {
 		log.Printf("ignoring repositoriy '%s' - is not a directory", repoPath)
 		return
 	}
 
-	repo := m.GetRepo(job.CommitRepo)
-	q := repo.GetQueue(job.QueueName, job.Context)
+	settings, err := config.LoadRepository(repoPath)
+	if err != nil {
+		log.Printf("Could not load settings for repository %s: %v", commitRepo, err)
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(responseWriter, "Could not process webhook: %+v", err)
+		return
+	}
+
+	// Default script is 'default.sh'.
+	// If a script is specified in the webhook URL as a parameter,
+	// we will try to use that instead.
+	contexts := []config.Context{{Name: m.cfg.Jobs.DefaultContext, Script: "default.sh"}}
+	query := r.URL.Query()
+	if query.Get("script") != "" || query.Get("context") != "" {
+		if s := query.Get("script"); s != "" {
+			contexts[0].Script = s
+		}
+
+		// Set the context to report back to gitea
+		if s := query.Get("context"); s != "" {
+			contexts[0].Name = s
+		}
+	} else if len(settings.Contexts) > 0 {
+		// Run one job for each context defined for the repository
+		contexts = settings.Contexts
+	}
+
+	// The response status is written once all contexts have been handled, since it cannot be changed
+	// after the first line of output. If any job cannot be queued, gitea is told to retry the webhook
+	var queued []string
+	status := http.StatusOK
+	var failure error
+
+	repo := m.GetRepo(commitRepo)
+	for _, c := range contexts {
+		// If no script is found, we might still find a configuration file in the repository
+		script := m.findScript(commitRepo, branchName, c.Script)
+		if script == "" && !m.cfg.Jobs.RepoConfig.Enabled {
+			continue
+		}
+
+		job := &job.Job{
+			Type:       typ,
+			Event:      ev,
+			API:        m.api,
+			Config:     m.cfg,
+			Context:    c.Name,
+			Script:     script,
+			QueueName:  queueName,
+			CommitRepo: commitRepo,
+			CommitID:   commitID,
+			TargetURL:  m.url.String(),
+		}
+
+		q := repo.GetQueue(job.QueueName, job.Context)
+		err := m.enqueue(job, q)
+		if errors.Is(err, errQueueFull) {
+			log.Printf("Rejecting job for %s: %v", job.CommitRepo, err)
+			status, failure = http.StatusServiceUnavailable, err
+			break
+		} else if err != nil {
+			log.Printf("SetupJob: %+v", err)
+			status, failure = http.StatusInternalServerError, err
+			break
+		}
+		queued = append(queued, job.TargetURL)
+	}
+
+	responseWriter.WriteHeader(status)
+	for _, u := range queued {
+		fmt.Fprintf(responseWriter, "Queued job %s\n", u)
+	}
+	if failure != nil {
+		fmt.Fprintf(responseWriter, "Could not process webhook: %+v", failure)
+	}
+}
+
+// findScript returns the path to the most specific version of a script available
+// for a branch in a repository, or an empty string if no script could be found
+func (m *Manager) findScript(repoName, branchName, scriptName string) string {
+	repoPath := filepath.Join(m.cfg.Scripts.Folder, path.Clean(repoName))
 
 	// Try to find the most specific version of the script available in the following order
 	//  - Branch-specific scripts
@@ -157,33 +287,256 @@ func (m *Manager) WebhookEvent(typ gitea.EventType, ev gitea.Event, responseWrit
 	}
 
 	for _, script := range scripts {
-		if !isFile(script) {
+		if isFile(script) {
+			return script
+		}
+	}
+	return ""
+}
+
+// ScriptRepos returns the names of all repositories that have a folder in the scripts folder
+func (m *Manager) ScriptRepos() []string {
+	owners, err := ioutil.ReadDir(m.cfg.Scripts.Folder)
+	if err != nil {
+		return nil
+	}
+
+	var repos []string
+	for _, owner := range owners {
+		if !owner.IsDir() {
 			continue
 		}
 
-		job.Script = script
-		err := job.Setup()
+		names, err := ioutil.ReadDir(filepath.Join(m.cfg.Scripts.Folder, owner.Name()))
 		if err != nil {
-			log.Printf("SetupJob: %+v", err)
-			responseWriter.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(responseWriter, "Could not process webhook: %+v", err)
-			return
+			continue
 		}
 
-		m.jobsMutex.Lock()
-		m.jobs[job.ID] = job
-		m.jobsMutex.Unlock()
+		for _, name := range names {
+			if name.IsDir() {
+				repos = append(repos, owner.Name()+"/"+name.Name())
+			}
+		}
+	}
+	return repos
+}
+
+// TriggerOptions describes a job that is triggered manually or by a schedule, instead of by a webhook
+type TriggerOptions struct {
+	Repository string
+	Ref        string // Branch to run the job on, defaults to the default branch of the repository
+	Commit     string // Commit to run the job on, defaults to the head of the branch
+	Script     string
+	Context    string
+	Queue      string // Queue to add the job to, defaults to the branch name
+}
+
+// invalidTriggerError is returned by TriggerJob when the options don't describe a job that can be created
+type invalidTriggerError struct {
+	msg string
+}
+
+func (e *invalidTriggerError) Error() string {
+	return e.msg
+}
+
+// giteaError is returned by TriggerJob when gitea cannot be asked about the repository or branch
+type giteaError struct {
+	err error
+}
+
+func (e *giteaError) Error() string {
+	return e.err.Error()
+}
+
+func (e *giteaError) Unwrap() error {
+	return e.err
+}
+
+// TriggerJob creates a job running a script for a branch or commit in a repository,
+// as if a push to that branch had been made.
+// Invalid options are reported with an invalidTriggerError, and failed requests to gitea with a giteaError
+func (m *Manager) TriggerJob(opts TriggerOptions) (*job.Job, error) {
+	repoName := strings.Trim(path.Clean(opts.Repository), "/")
+	if !isDir(filepath.Join(m.cfg.Scripts.Folder, repoName)) {
+		return nil, &invalidTriggerError{fmt.Sprintf("unknown repository '%s'", repoName)}
+	}
+
+	scriptName := opts.Script
+	if scriptName == "" {
+		scriptName = "default.sh"
+	}
+
+	context := opts.Context
+	if context == "" {
+		context = m.cfg.Jobs.DefaultContext
+	}
+
+	repoInfo, err := getRepository(m.api, repoName)
+	if errors.Is(err, errNotFound) {
+		return nil, &invalidTriggerError{fmt.Sprintf("repository '%s' not found in gitea", repoName)}
+	} else if err != nil {
+		return nil, &giteaError{fmt.Errorf("could not get repository information: %w", err)}
+	}
 
-		// Cancel previous run of this particular job, if we have one (and setting is active)
-		if lastJob := q.GetLastJob(); lastJob != nil && m.cfg.Jobs.CancelPrevious {
-			lastJob.Cancel()
+	branchName := strings.TrimPrefix(opts.Ref, "refs/heads/")
+	if branchName == "" {
+		branchName = repoInfo.DefaultBranch
+	}
+	if branchName == "" {
+		return nil, &invalidTriggerError{"no branch specified"}
+	}
+
+	script := m.findScript(repoName, branchName, scriptName)
+	if script == "" && !m.cfg.Jobs.RepoConfig.Enabled {
+		return nil, &invalidTriggerError{fmt.Sprintf("script '%s' not found for repository '%s'", scriptName, repoName)}
+	}
+
+	commitID := opts.Commit
+	if commitID == "" {
+		commitID, err = getBranchCommit(m.api, repoName, branchName)
+		if errors.Is(err, errNotFound) {
+			return nil, &invalidTriggerError{fmt.Sprintf("branch '%s' not found", branchName)}
+		} else if err != nil {
+			return nil, &giteaError{fmt.Errorf("could not get head of branch '%s': %w", branchName, err)}
 		}
-		q.AddJob(job)
+	}
+
+	queueName := opts.Queue
+	if queueName == "" {
+		queueName = branchName
+	}
+
+	// The preparation scripts expect the same information as a push event would contain
+	ev := gitea.Event{
+		Ref:        "refs/heads/" + branchName,
+		After:      commitID,
+		Repository: repoInfo,
+	}
+
+	j := &job.Job{
+		Type:       gitea.EventTypePush,
+		Event:      ev,
+		API:        m.api,
+		Config:     m.cfg,
+		Context:    context,
+		Script:     script,
+		QueueName:  queueName,
+		CommitRepo: repoInfo.FullName,
+		CommitID:   commitID,
+		TargetURL:  m.url.String(),
+	}
+
+	q := m.GetRepo(j.CommitRepo).GetQueue(j.QueueName, j.Context)
+	err = m.enqueue(j, q)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// RerunJob creates a new job with the same event, script and context as an existing job,
+// and adds it to the same queue
+func (m *Manager) RerunJob(prev *job.Job) (*job.Job, error) {
+	if prev.Script != "" && !isFile(prev.Script) {
+		return nil, fmt.Errorf("script '%s' no longer exists", prev.Script)
+	}
+
+	j := &job.Job{
+		Type:       prev.Type,
+		Event:      prev.Event,
+		API:        m.api,
+		Config:     m.cfg,
+		Context:    prev.Context,
+		Script:     prev.Script,
+		QueueName:  prev.QueueName,
+		CommitRepo: prev.CommitRepo,
+		CommitID:   prev.CommitID,
+		TargetURL:  m.url.String(),
+		RerunOf:    prev.ID,
+	}
+
+	q := m.GetRepo(j.CommitRepo).GetQueue(j.QueueName, j.Context)
+	err := m.enqueue(j, q)
+	if err != nil {
+		return nil, err
+	}
 
-		// Add job to manager queue
-		m.workerCh <- job
-		break
+	err = prev.AddRerun(j.ID)
+	if err != nil {
+		log.Printf("Could not save job %s: %v", prev.ID, err)
 	}
+	return j, nil
+}
+
+// enqueue prepares a job, adds it to queue q, and places it in the list of jobs waiting for a worker
+func (m *Manager) enqueue(j *job.Job, q *Queue) error {
+	settings, err := config.LoadRepository(filepath.Join(m.cfg.Scripts.Folder, path.Clean(j.CommitRepo)))
+	if err != nil {
+		return fmt.Errorf("could not load settings for repository %s: %w", j.CommitRepo, err)
+	}
+	j.Settings = settings.ForScript(m.cfg.Jobs.Defaults, j.Script)
+
+	// The webhook secret is not needed by the job, and should neither be stored nor passed to scripts
+	j.Event.Secret = ""
+
+	j.Secrets, err = m.jobSecrets(j)
+	if err != nil {
+		return fmt.Errorf("could not load secrets for repository %s: %w", j.CommitRepo, err)
+	}
+
+	j.Mirror = m.GetRepo(j.CommitRepo).Mirror
+
+	// Room in the pending queue is reserved before the job is set up,
+	// so that a rejected job neither is saved nor cancels the previous job
+	err = m.pending.Reserve()
+	if err != nil {
+		return err
+	}
+
+	err = j.Setup()
+	if err != nil {
+		m.pending.Release()
+		return err
+	}
+
+	m.jobsMutex.Lock()
+	m.jobs[j.ID] = j
+	m.jobsMutex.Unlock()
+
+	lastJob := q.GetLastJob()
+	q.AddJob(j)
+
+	// Add job to manager queue
+	m.pending.Push(j)
+
+	// Cancel previous run of this particular job, if we have one (and setting is active)
+	if lastJob != nil && m.cfg.Jobs.CancelPrevious {
+		lastJob.Cancel()
+	}
+	return nil
+}
+
+// jobSecrets returns the decrypted secrets of the repository that are available to a job
+func (m *Manager) jobSecrets(j *job.Job) ([]job.Secret, error) {
+	store, err := secrets.Load(filepath.Join(m.cfg.Scripts.Folder, path.Clean(j.CommitRepo)), m.secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []job.Secret
+	for _, s := range store.Secrets {
+		if !s.AvailableTo(j.Context, j.IsForkPullRequest()) {
+			continue
+		}
+
+		value, err := store.Decrypt(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, job.Secret{Name: s.Name, Value: value, File: s.File})
+	}
+	return list, nil
 }
 
 // GetJob returns a Job structure, either from memory if it exists, or recreated from disk
@@ -199,9 +552,20 @@ func (m *Manager) GetJob(id string) (*job.Job, error) {
 	}
 
 	// Otherwise, recreate j from disk
+	j, err := m.readJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.addJob(j), nil
+}
+
+// readJob recreates a job from the information saved in its job folder
+func (m *Manager) readJob(id string) (*job.Job, error) {
 	jobPath := filepath.Join(m.cfg.Jobs.Folder, id)
 	st, err := os.Stat(jobPath)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -213,8 +577,9 @@ func (m *Manager) GetJob(id string) (*job.Job, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	j = &job.Job{}
+	j := &job.Job{}
 	err = json.NewDecoder(f).Decode(&j)
 	if err != nil {
 		return nil, err
@@ -222,6 +587,8 @@ func (m *Manager) GetJob(id string) (*job.Job, error) {
 
 	j.ID = id
 	j.Folder = jobPath
+	j.API = m.api
+	j.Config = m.cfg
 
 	// If j is still in status pending, it means that the
 	// server was killed before it finished, so we'll consider it cancelled
@@ -229,16 +596,49 @@ func (m *Manager) GetJob(id string) (*job.Job, error) {
 		j.Status = job.StatusCancelled
 	}
 
+	// Jobs created before timestamps were recorded are dated by their folder
+	if j.Created.IsZero() {
+		j.Created = st.ModTime()
+	}
+	return j, nil
+}
+
+// addJob adds a job loaded from disk to the repository/queue list,
+// unless it has already been loaded, in which case the existing job is returned
+func (m *Manager) addJob(j *job.Job) *job.Job {
+	m.jobsMutex.Lock()
+	defer m.jobsMutex.Unlock()
+
+	if existing, ok := m.jobs[j.ID]; ok {
+		return existing
+	}
+
 	// Populate repository/queue list
 	repo := m.GetRepo(j.CommitRepo)
 	q := repo.GetQueue(j.QueueName, j.Context)
 	q.AddJob(j)
 
 	// Save in memory for later
-	m.jobsMutex.Lock()
-	defer m.jobsMutex.Unlock()
-	m.jobs[id] = j
-	return j, nil
+	m.jobs[j.ID] = j
+	return j
+}
+
+// GetActiveJobs returns all jobs that are either pending or executing, oldest first
+func (m *Manager) GetActiveJobs() []*job.Job {
+	m.jobsMutex.RLock()
+	defer m.jobsMutex.RUnlock()
+
+	var jobs []*job.Job
+	for _, j := range m.jobs {
+		if !j.Status.IsFinished() {
+			jobs = append(jobs, j)
+		}
+	}
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+	return jobs
 }
 
 // LoadJobs adds all existing jobs found in the jobs-folder
@@ -254,19 +654,27 @@ func (m *Manager) LoadJobs() error {
 		return err
 	}
 
-	// Attempt to load jobs in the correct order
-	sort.Slice(contents, func(i, j int) bool {
-		return contents[i].ModTime().UnixNano() < contents[j].ModTime().UnixNano()
-	})
-
+	var jobs []*job.Job
 	for k := range contents {
-		if contents[k].IsDir() {
-			// Recurse into directories
-			_, err := m.GetJob(contents[k].Name())
-			if err != nil {
-				log.Printf("Could not load job %s: %v", contents[k].Name(), err)
-			}
+		if !contents[k].IsDir() {
+			continue
+		}
+
+		j, err := m.readJob(contents[k].Name())
+		if err != nil {
+			log.Printf("Could not load job %s: %v", contents[k].Name(), err)
+			continue
 		}
+		jobs = append(jobs, j)
+	}
+
+	// Add jobs in the order they were created, so that the queues are correctly ordered
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+
+	for _, j := range jobs {
+		m.addJob(j)
 	}
 	return nil
 }
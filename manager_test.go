@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	gitea "github.com/yzzyx/gitea-webhook"
+	"github.com/yzzyx/microci/config"
+	"github.com/yzzyx/microci/job"
+	"github.com/yzzyx/microci/secrets"
+)
+
+func TestJobSecrets(t *testing.T) {
+	folder, err := ioutil.TempDir("", "microci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	encoded, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := secrets.ParseKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := secrets.Load(filepath.Join(folder, "owner", "repo"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []secrets.Secret{
+		{Name: "ALL"},
+		{Name: "DEPLOY", Contexts: []string{"deploy"}},
+		{Name: "FORKS", AllowForks: true},
+	} {
+		err = store.Set(s, strings.ToLower(s.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Scripts.Folder = folder
+	m := &Manager{cfg: cfg, secretKey: key}
+
+	pullRequest := func(headRepo string) gitea.Event {
+		ev := gitea.Event{}
+		ev.PullRequest.Base.Repo.FullName = "owner/repo"
+		ev.PullRequest.Head.Repo.FullName = headRepo
+		return ev
+	}
+
+	tests := []struct {
+		name string
+		job  *job.Job
+		want []string
+	}{
+		{name: "push", job: &job.Job{CommitRepo: "owner/repo", Type: gitea.EventTypePush}, want: []string{"ALL=all", "FORKS=forks"}},
+		{name: "context", job: &job.Job{CommitRepo: "owner/repo", Type: gitea.EventTypePush, Context: "deploy"}, want: []string{"ALL=all", "DEPLOY=deploy", "FORKS=forks"}},
+		{name: "pull request", job: &job.Job{CommitRepo: "owner/repo", Type: gitea.EventTypePullRequest, Event: pullRequest("owner/repo")}, want: []string{"ALL=all", "FORKS=forks"}},
+		{name: "fork", job: &job.Job{CommitRepo: "owner/repo", Type: gitea.EventTypePullRequest, Event: pullRequest("fork/repo")}, want: []string{"FORKS=forks"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := m.jobSecrets(tt.job)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, s := range list {
+				got = append(got, s.Name+"="+s.Value)
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got secrets %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunMirrorMaintenance periodically fetches new commits into the git mirrors of all repositories,
+// and cleans them up, until ctx is cancelled
+func (m *Manager) RunMirrorMaintenance(ctx context.Context) {
+	interval := m.cfg.Cache.MirrorInterval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		for _, repo := range m.GetRepos() {
+			err := repo.Mirror.Maintain(ctx)
+			if err != nil {
+				log.Printf("Could not update git mirror of %s: %v", repo.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/yzzyx/microci/job"
+)
+
+// Policies used when a job is added to a full queue
+const (
+	// OverflowReject rejects the new job
+	OverflowReject = "reject"
+	// OverflowDropOldest cancels the oldest pending job to make room for the new one
+	OverflowDropOldest = "drop_oldest"
+)
+
+var errQueueFull = errors.New("job queue is full")
+
+// pendingQueue keeps track of jobs waiting for a free worker
+type pendingQueue struct {
+	capacity int // Maximum number of pending jobs, zero means unlimited
+	overflow string
+
+	jobs      []*job.Job
+	reserved  int              // Number of jobs that have reserved room, but have not been pushed yet
+	positions map[*job.Job]int // Last reported position of each job
+	closed    bool
+
+	mx   *sync.Mutex
+	cond *sync.Cond
+}
+
+func newPendingQueue(capacity int, overflow string) (*pendingQueue, error) {
+	switch overflow {
+	case OverflowReject, OverflowDropOldest:
+	default:
+		return nil, fmt.Errorf("invalid queue overflow policy '%s', must be one of '%s' or '%s'", overflow, OverflowReject, OverflowDropOldest)
+	}
+
+	mx := &sync.Mutex{}
+	return &pendingQueue{
+		capacity:  capacity,
+		overflow:  overflow,
+		positions: map[*job.Job]int{},
+		mx:        mx,
+		cond:      sync.NewCond(mx),
+	}, nil
+}
+
+// Reserve reserves room for a job, before the job is set up and pushed to the queue.
+// If the queue is full and the overflow policy rejects new jobs, errQueueFull is returned.
+// Each successful call must be followed by a call to either Push or Release
+func (p *pendingQueue) Reserve() error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.prune()
+	if p.capacity > 0 && p.overflow == OverflowReject && len(p.jobs)+p.reserved >= p.capacity {
+		return errQueueFull
+	}
+	p.reserved++
+	return nil
+}
+
+// Release gives back room reserved for a job that will not be pushed
+func (p *pendingQueue) Release() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.reserved--
+}
+
+// Push adds a job to the end of the queue, using the room reserved for it.
+// If the queue is full, the oldest pending job is cancelled to make room for it
+func (p *pendingQueue) Push(j *job.Job) {
+	p.mx.Lock()
+	p.reserved--
+	p.prune()
+	var dropped *job.Job
+	if p.capacity > 0 && len(p.jobs) >= p.capacity {
+		dropped = p.jobs[0]
+		p.remove(dropped)
+	}
+
+	p.jobs = append(p.jobs, j)
+	p.updatePositions()
+	p.cond.Signal()
+	p.mx.Unlock()
+
+	// The dropped job has already left the queue, so it's cancelled without holding the lock
+	if dropped != nil {
+		dropped.CancelWithDescription("dropped from full job queue")
+		err := dropped.Save()
+		if err != nil {
+			log.Printf("Could not save job status: %v", err)
+		}
+	}
+}
+
+// Next waits for the first job in the queue, and returns it without removing it,
+// so that it keeps its position until a worker has accepted it.
+// It returns nil when the queue has been closed.
+func (p *pendingQueue) Next() *job.Job {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for {
+		if p.closed {
+			return nil
+		}
+
+		p.prune()
+		if len(p.jobs) > 0 {
+			return p.jobs[0]
+		}
+		p.cond.Wait()
+	}
+}
+
+// Remove removes a job from the queue, and updates the position of the remaining jobs
+func (p *pendingQueue) Remove(j *job.Job) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.remove(j)
+	p.updatePositions()
+}
+
+// Close wakes up anyone waiting for jobs
+func (p *pendingQueue) Close() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// remove removes a job from the queue. The caller must hold p.mx
+func (p *pendingQueue) remove(j *job.Job) {
+	for k := range p.jobs {
+		if p.jobs[k] == j {
+			p.jobs = append(p.jobs[:k], p.jobs[k+1:]...)
+			break
+		}
+	}
+	delete(p.positions, j)
+}
+
+// prune removes jobs that were cancelled while waiting. The caller must hold p.mx
+func (p *pendingQueue) prune() {
+	jobs := p.jobs[:0]
+	for _, j := range p.jobs {
+		if j.Status.IsFinished() {
+			delete(p.positions, j)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	p.jobs = jobs
+}
+
+// updatePositions informs all pending jobs whose position has changed. The caller must hold p.mx
+func (p *pendingQueue) updatePositions() {
+	p.prune()
+	for k, j := range p.jobs {
+		pos := k + 1
+		if p.positions[j] == pos {
+			continue
+		}
+		p.positions[j] = pos
+		j.SetPendingDescription(fmt.Sprintf("Waiting in queue (position %d)", pos))
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/yzzyx/microci/job"
@@ -22,6 +23,7 @@ type Queue struct {
 type Repository struct {
 	Name   string
 	Queues []*Queue
+	Mirror *job.Mirror // Git mirror shared by all jobs in the repository
 
 	mx *sync.Mutex
 }
@@ -33,6 +35,19 @@ func (q *Queue) AddJob(j *job.Job) {
 	q.jobs = append([]*job.Job{j}, q.jobs...)
 }
 
+// RemoveJob removes a specific job from the queue
+func (q *Queue) RemoveJob(id string) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	for k := range q.jobs {
+		if q.jobs[k].ID == id {
+			q.jobs = append(q.jobs[:k], q.jobs[k+1:]...)
+			return
+		}
+	}
+}
+
 // GetJob returns a specific job
 func (q *Queue) GetJob(id string) *job.Job {
 	q.mx.RLock()
@@ -58,6 +73,16 @@ func (q *Queue) GetLastJob() *job.Job {
 	return q.jobs[0]
 }
 
+// GetJobs returns all jobs in the queue, newest first
+func (q *Queue) GetJobs() []*job.Job {
+	q.mx.RLock()
+	defer q.mx.RUnlock()
+
+	jobs := make([]*job.Job, len(q.jobs))
+	copy(jobs, q.jobs)
+	return jobs
+}
+
 // NewRepository returns a newly initialized repository
 func NewRepository(name string) *Repository {
 	return &Repository{
@@ -67,6 +92,22 @@ func NewRepository(name string) *Repository {
 	}
 }
 
+// GetQueues returns all queues in the repository, sorted by name and context
+func (r *Repository) GetQueues() []*Queue {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	queues := make([]*Queue, len(r.Queues))
+	copy(queues, r.Queues)
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].Name == queues[j].Name {
+			return queues[i].Context < queues[j].Context
+		}
+		return queues[i].Name < queues[j].Name
+	})
+	return queues
+}
+
 // GetQueue returns a queue matching the supplied named and context
 func (r *Repository) GetQueue(name, context string) *Queue {
 	r.mx.Lock()
@@ -0,0 +1,202 @@
+// Package schedule parses cron expressions, and calculates when they should be triggered
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes when a job should be triggered, as specified by a cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // Bitmasks of matching values
+
+	// Day-of-month and day-of-week are combined with OR if both are restricted
+	domRestricted, dowRestricted bool
+}
+
+// field describes the allowed range of a single field in a cron expression
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// shortcuts are predefined schedules that can be used instead of a full expression
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a standard five-field cron expression ("minute hour day-of-month month day-of-week"),
+// or one of the shortcuts @yearly, @monthly, @weekly, @daily and @hourly
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if s, ok := shortcuts[strings.ToLower(expr)]; ok {
+		expr = s
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s': expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+
+	// Sunday can be specified as both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// value parses a single value, either a number or a name
+func (f field) value(str string) (int, error) {
+	if v, ok := f.names[strings.ToLower(str)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(str)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s '%s', must be between %d and %d", f.name, str, f.min, f.max)
+	}
+	return v, nil
+}
+
+// parse parses a comma-separated list of values, ranges and steps into a bitmask
+func (f field) parse(str string) (uint64, error) {
+	var mask uint64
+
+	for _, part := range strings.Split(str, ",") {
+		step := 1
+		if idx := strings.IndexByte(part, '/'); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s '%s'", f.name, part)
+			}
+			part = part[:idx]
+		}
+
+		start, end := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			idx := strings.IndexByte(part, '-')
+			var err error
+			if start, err = f.value(part[:idx]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(part[idx+1:]); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range in %s '%s'", f.name, part)
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			start = v
+			// "5/15" means every 15 starting at 5
+			if step == 1 {
+				end = v
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+// matchesDay returns true if the day of t is matched by the schedule
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time after t that matches the schedule.
+// If no such time can be found within five years, the zero time is returned
+func (s *Schedule) Next(t time.Time) time.Time {
+	// The schedule is matched against the wall clock, which is stepped in UTC so that daylight saving time
+	// doesn't skip any days. Times that don't exist when the clock is moved forward are run after the change
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := wall.AddDate(5, 0, 0)
+
+	for wall.Before(limit) {
+		if s.month&(1<<uint(wall.Month())) == 0 {
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !s.matchesDay(wall) {
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.hour&(1<<uint(wall.Hour())) == 0 {
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.minute&(1<<uint(wall.Minute())) == 0 {
+			wall = wall.Add(time.Minute)
+			continue
+		}
+
+		// Times that occur twice when the clock is moved back may be resolved to either occurrence,
+		// so make sure that we never return a time before t
+		next := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, t.Location())
+		if next.After(t) {
+			return next
+		}
+		wall = wall.Add(time.Minute)
+	}
+	return time.Time{}
+}
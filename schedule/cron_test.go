@@ -0,0 +1,198 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"x * * * *",
+		"* * * foo *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"@reboot",
+	}
+
+	for _, expr := range tests {
+		_, err := Parse(expr)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, expected an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		loc  *time.Location // Location the schedule is matched in, if not the location of from
+		want []time.Time    // Times returned by calling Next repeatedly
+	}{
+		{
+			name: "every 15 minutes",
+			expr: "*/15 * * * *",
+			from: utc(2026, 1, 1, 10, 7),
+			want: []time.Time{utc(2026, 1, 1, 10, 15), utc(2026, 1, 1, 10, 30), utc(2026, 1, 1, 10, 45), utc(2026, 1, 1, 11, 0)},
+		},
+		{
+			name: "seconds are ignored",
+			expr: "*/15 * * * *",
+			from: utc(2026, 1, 1, 10, 15).Add(30 * time.Second),
+			want: []time.Time{utc(2026, 1, 1, 10, 30)},
+		},
+		{
+			name: "step from a start value",
+			expr: "5/20 * * * *",
+			from: utc(2026, 1, 1, 10, 30),
+			want: []time.Time{utc(2026, 1, 1, 10, 45), utc(2026, 1, 1, 11, 5)},
+		},
+		{
+			name: "end of year",
+			expr: "*/15 * * * *",
+			from: utc(2026, 12, 31, 23, 59),
+			want: []time.Time{utc(2027, 1, 1, 0, 0)},
+		},
+		{
+			name: "weekdays",
+			expr: "0 9 * * 1-5",
+			from: utc(2026, 10, 16, 10, 0), // Friday
+			want: []time.Time{utc(2026, 10, 19, 9, 0), utc(2026, 10, 20, 9, 0)},
+		},
+		{
+			name: "named weekdays and months",
+			expr: "0 9 * jan-feb mon-fri",
+			from: utc(2026, 10, 16, 10, 0),
+			want: []time.Time{utc(2027, 1, 1, 9, 0), utc(2027, 1, 4, 9, 0)},
+		},
+		{
+			name: "31st of the month",
+			expr: "0 0 31 * *",
+			from: utc(2026, 1, 31, 0, 0),
+			want: []time.Time{utc(2026, 3, 31, 0, 0), utc(2026, 5, 31, 0, 0), utc(2026, 7, 31, 0, 0), utc(2026, 8, 31, 0, 0)},
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: utc(2026, 3, 1, 0, 0),
+			want: []time.Time{utc(2028, 2, 29, 0, 0), utc(2032, 2, 29, 0, 0)},
+		},
+		{
+			name: "sunday as 0 and 7",
+			expr: "0 0 * * 0,7",
+			from: utc(2026, 10, 16, 0, 0),
+			want: []time.Time{utc(2026, 10, 18, 0, 0), utc(2026, 10, 25, 0, 0)},
+		},
+		{
+			name: "sunday as 7",
+			expr: "0 0 * * 7",
+			from: utc(2026, 10, 16, 0, 0),
+			want: []time.Time{utc(2026, 10, 18, 0, 0)},
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 0 13 * 5",
+			from: utc(2026, 10, 1, 0, 0),
+			want: []time.Time{utc(2026, 10, 2, 0, 0), utc(2026, 10, 9, 0, 0), utc(2026, 10, 13, 0, 0), utc(2026, 10, 16, 0, 0)},
+		},
+		{
+			name: "yearly",
+			expr: "@yearly",
+			from: utc(2026, 6, 1, 0, 0),
+			want: []time.Time{utc(2027, 1, 1, 0, 0), utc(2028, 1, 1, 0, 0)},
+		},
+		{
+			name: "never",
+			expr: "0 0 30 2 *",
+			from: utc(2026, 1, 1, 0, 0),
+			want: []time.Time{{}},
+		},
+		{
+			name: "skipped time when daylight saving time starts",
+			expr: "30 2 * * *",
+			from: time.Date(2026, 3, 28, 12, 0, 0, 0, stockholm),
+			want: []time.Time{
+				time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC), // 03:30 CEST
+				time.Date(2026, 3, 30, 0, 30, 0, 0, time.UTC), // 02:30 CEST
+			},
+		},
+		{
+			name: "hourly when daylight saving time starts",
+			loc:  stockholm,
+			expr: "0 * * * *",
+			from: time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC), // 01:30 CET
+			want: []time.Time{
+				time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), // 03:00 CEST
+				time.Date(2026, 3, 29, 2, 0, 0, 0, time.UTC), // 04:00 CEST
+			},
+		},
+		{
+			name: "repeated time when daylight saving time ends",
+			expr: "30 2 * * *",
+			from: time.Date(2026, 10, 24, 12, 0, 0, 0, stockholm),
+			want: []time.Time{
+				time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC), // 02:30 CET, the second occurrence
+				time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "repeated time from its first occurrence",
+			loc:  stockholm,
+			expr: "30 2 * * *",
+			from: time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), // 02:30 CEST
+			want: []time.Time{time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC)},
+		},
+		{
+			name: "repeated time from its second occurrence",
+			loc:  stockholm,
+			expr: "30 2 * * *",
+			from: time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC), // 02:30 CET
+			want: []time.Time{time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned %v", tt.expr, err)
+			}
+
+			from := tt.from
+			if tt.loc != nil {
+				from = from.In(tt.loc)
+			}
+			for _, want := range tt.want {
+				next := s.Next(from)
+				if !next.Equal(want) {
+					t.Fatalf("Next(%v) = %v, expected %v", from, next, want)
+				}
+				from = next
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/yzzyx/microci/config"
+	"github.com/yzzyx/microci/schedule"
+)
+
+// RunScheduler starts jobs defined in the schedules of each repository, until ctx is cancelled.
+// Repository settings are re-read every minute, so that changes take effect without a restart
+func (m *Manager) RunScheduler(ctx context.Context) {
+	last := time.Now()
+
+	for {
+		// Wake up at the start of the next minute
+		now := time.Now()
+		wait := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		now = time.Now()
+		m.runSchedules(last, now)
+		last = now
+	}
+}
+
+// runSchedules starts all scheduled jobs that should have been started between 'from' and 'to'
+func (m *Manager) runSchedules(from, to time.Time) {
+	for _, repoName := range m.ScriptRepos() {
+		settings, err := config.LoadRepository(filepath.Join(m.cfg.Scripts.Folder, repoName))
+		if err != nil {
+			log.Printf("Could not load settings for repository %s: %v", repoName, err)
+			continue
+		}
+
+		for _, s := range settings.Schedules {
+			sched, err := schedule.Parse(s.Cron)
+			if err != nil {
+				log.Printf("Invalid schedule '%s' in repository %s: %v", s.Name, repoName, err)
+				continue
+			}
+
+			next := sched.Next(from)
+			if next.IsZero() || next.After(to) {
+				continue
+			}
+
+			log.Printf("Starting scheduled job '%s' for repository %s", s.Name, repoName)
+			_, err = m.TriggerJob(TriggerOptions{
+				Repository: repoName,
+				Ref:        s.Branch,
+				Script:     s.Script,
+				Context:    s.Context,
+				Queue:      "schedule:" + s.Name,
+			})
+			if err != nil {
+				log.Printf("Could not start scheduled job '%s' for repository %s: %v", s.Name, repoName, err)
+			}
+		}
+	}
+}
@@ -27,5 +27,6 @@ export GIT_TERMINAL_PROMPT=0
 # Echo the commands we're executing, so that they get logged
 set -x
 git clone -v "$REPOSITORY_CLONEURL" .
-git checkout -b target remotes/origin/"${REF#refs/heads/}"
+# Check out the commit that triggered the job if we know it, otherwise the head of the branch
+git checkout -b target "${AFTER:-remotes/origin/${REF#refs/heads/}}"
 set +x
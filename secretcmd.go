@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yzzyx/microci/config"
+	"github.com/yzzyx/microci/secrets"
+)
+
+// validSecretName matches names that can be used as environment variables
+var validSecretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// stringList is a flag that can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func secretUsage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  microci secret generate-key")
+	fmt.Fprintln(os.Stderr, "  microci secret set [-context name]... [-file] [-allow-forks] owner/repo NAME < value")
+	fmt.Fprintln(os.Stderr, "  microci secret delete owner/repo NAME")
+	fmt.Fprintln(os.Stderr, "  microci secret list owner/repo")
+}
+
+// loadSecretStore loads the secrets of the repository specified as "owner/repo"
+func loadSecretStore(cfg *config.Config, repo string) (*secrets.Store, error) {
+	repo = path.Clean(repo)
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 || parts[0] == ".." || parts[1] == ".." || parts[0] == "" {
+		return nil, fmt.Errorf("invalid repository '%s', must be specified as owner/repo", repo)
+	}
+
+	var key []byte
+	if cfg.Secrets.Key != "" {
+		var err error
+		key, err = secrets.ParseKey(cfg.Secrets.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return secrets.Load(filepath.Join(cfg.Scripts.Folder, repo), key)
+}
+
+// secretCommand manages the secrets stored for repositories
+func secretCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		secretUsage()
+		return errors.New("no command specified")
+	}
+
+	flags := flag.NewFlagSet("secret "+args[0], flag.ExitOnError)
+	flags.Usage = secretUsage
+
+	switch args[0] {
+	case "generate-key":
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "set":
+		var contexts stringList
+		flags.Var(&contexts, "context", "only make the secret available to jobs with this context")
+		file := flags.Bool("file", false, "store the secret in a file, and set the variable to the path of the file")
+		allowForks := flags.Bool("allow-forks", false, "make the secret available to pull requests from forks")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			secretUsage()
+			return errors.New("repository and name must be specified")
+		}
+
+		name := flags.Arg(1)
+		if !validSecretName.MatchString(name) {
+			return fmt.Errorf("invalid secret name '%s'", name)
+		}
+
+		store, err := loadSecretStore(cfg, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		value, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if !*file {
+			// Allow values to be passed with e.g. echo, without including the newline
+			value = []byte(strings.TrimRight(string(value), "\r\n"))
+		}
+		if len(value) == 0 {
+			return errors.New("no value specified on stdin")
+		}
+
+		secret := secrets.Secret{
+			Name:       name,
+			Contexts:   contexts,
+			File:       *file,
+			AllowForks: *allowForks,
+		}
+		err = store.Set(secret, string(value))
+		if err != nil {
+			return err
+		}
+		return store.Save()
+
+	case "delete":
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			secretUsage()
+			return errors.New("repository and name must be specified")
+		}
+
+		store, err := loadSecretStore(cfg, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !store.Remove(flags.Arg(1)) {
+			return fmt.Errorf("no secret named '%s' found", flags.Arg(1))
+		}
+		return store.Save()
+
+	case "list":
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			secretUsage()
+			return errors.New("repository must be specified")
+		}
+
+		store, err := loadSecretStore(cfg, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, s := range store.Secrets {
+			var options []string
+			if len(s.Contexts) > 0 {
+				options = append(options, "contexts: "+strings.Join(s.Contexts, ","))
+			}
+			if s.File {
+				options = append(options, "file")
+			}
+			if s.AllowForks {
+				options = append(options, "allow forks")
+			}
+			fmt.Printf("%s\t%s\n", s.Name, strings.Join(options, "; "))
+		}
+		return nil
+	}
+
+	secretUsage()
+	return fmt.Errorf("unknown command '%s'", args[0])
+}
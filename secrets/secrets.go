@@ -0,0 +1,209 @@
+// Package secrets stores encrypted secrets for repositories, which are made available to jobs
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File is the name of the file containing the secrets of a repository,
+// located in the repository's folder in the scripts folder
+const File = "secrets.json"
+
+// KeySize is the size of the key used to encrypt secrets (AES-256)
+const KeySize = 32
+
+// Secret is a single value that is made available to jobs in a repository
+type Secret struct {
+	Name string `json:"name"`
+	// Value is encrypted with AES-GCM and base64 encoded
+	Value string `json:"value"`
+	// Contexts that the secret is available to. If empty, it's available to all contexts
+	Contexts []string `json:"contexts,omitempty"`
+	// If set, the secret is written to a file, and the variable contains the path to the file
+	File bool `json:"file,omitempty"`
+	// If set, the secret is also available to jobs for pull requests from forks
+	AllowForks bool `json:"allow_forks,omitempty"`
+}
+
+// AvailableTo returns true if the secret should be made available to a job
+func (s Secret) AvailableTo(context string, fork bool) bool {
+	if fork && !s.AllowForks {
+		return false
+	}
+
+	if len(s.Contexts) == 0 {
+		return true
+	}
+	for _, c := range s.Contexts {
+		if c == context {
+			return true
+		}
+	}
+	return false
+}
+
+// Store contains the secrets of a single repository
+type Store struct {
+	Secrets []Secret `json:"secrets"`
+
+	folder string
+	key    []byte
+}
+
+// ParseKey decodes a base64 encoded key
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid secrets key: must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// GenerateKey returns a new random base64 encoded key
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Load reads the secrets stored in folder.
+// If no secrets file exists, an empty store is returned
+func Load(folder string, key []byte) (*Store, error) {
+	s := &Store{folder: folder, key: key}
+
+	data, err := ioutil.ReadFile(filepath.Join(folder, File))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", filepath.Join(folder, File), err)
+	}
+	return s, nil
+}
+
+// Save writes the secrets to disk
+func (s *Store) Save() error {
+	sort.Slice(s.Secrets, func(i, j int) bool {
+		return s.Secrets[i].Name < s.Secrets[j].Name
+	})
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that we never leave a partially written file behind
+	tmpFile := filepath.Join(s.folder, File+".tmp")
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filepath.Join(s.folder, File))
+}
+
+// Set encrypts value, and adds or replaces the secret with the same name
+func (s *Store) Set(secret Secret, value string) error {
+	var err error
+	secret.Value, err = s.encrypt(value)
+	if err != nil {
+		return err
+	}
+
+	for i := range s.Secrets {
+		if s.Secrets[i].Name == secret.Name {
+			s.Secrets[i] = secret
+			return nil
+		}
+	}
+	s.Secrets = append(s.Secrets, secret)
+	return nil
+}
+
+// Remove removes the secret with the specified name, and returns false if it did not exist
+func (s *Store) Remove(name string) bool {
+	for i := range s.Secrets {
+		if s.Secrets[i].Name == name {
+			s.Secrets = append(s.Secrets[:i], s.Secrets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt returns the value of a secret
+func (s *Store) Decrypt(secret Secret) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(secret.Value)
+	if err != nil {
+		return "", fmt.Errorf("could not decode secret %s: %w", secret.Name, err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("could not decrypt secret %s: value too short", secret.Name)
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret %s: %w", secret.Name, err)
+	}
+	return string(plaintext), nil
+}
+
+// encrypt encrypts value with a random nonce, which is stored in front of the encrypted data
+func (s *Store) encrypt(value string) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	data := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (s *Store) cipher() (cipher.AEAD, error) {
+	if len(s.key) == 0 {
+		return nil, errors.New("no secrets key configured")
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
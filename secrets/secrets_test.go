@@ -0,0 +1,166 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestStore returns an empty store in a temporary folder, using a new key
+func newTestStore(t *testing.T) *Store {
+	folder, err := ioutil.TempDir("", "microci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(folder, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newTestStore(t)
+
+	values := map[string]string{
+		"TOKEN":   "hunter2",
+		"EMPTY":   "",
+		"KEYFILE": "-----BEGIN KEY-----\nabc\ndef\n-----END KEY-----\n",
+	}
+	for name, value := range values {
+		err := s.Set(Secret{Name: name}, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(s.folder, s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Secrets) != len(values) {
+		t.Fatalf("loaded %d secrets, expected %d", len(loaded.Secrets), len(values))
+	}
+
+	for _, secret := range loaded.Secrets {
+		if values[secret.Name] != "" && strings.Contains(secret.Value, values[secret.Name]) {
+			t.Errorf("secret %s is stored in plain text", secret.Name)
+		}
+
+		value, err := loaded.Decrypt(secret)
+		if err != nil {
+			t.Errorf("could not decrypt %s: %v", secret.Name, err)
+		} else if value != values[secret.Name] {
+			t.Errorf("secret %s decrypted to %q, expected %q", secret.Name, value, values[secret.Name])
+		}
+	}
+}
+
+func TestEncryptUsesRandomNonce(t *testing.T) {
+	s := newTestStore(t)
+
+	a, err := s.encrypt("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.encrypt("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("encrypting the same value twice gave the same result")
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	s := newTestStore(t)
+	err := s.Set(Secret{Name: "TOKEN"}, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := s.Secrets[0]
+
+	tampered := []byte(secret.Value)
+	tampered[len(tampered)/2] ^= 1
+
+	tests := []struct {
+		name   string
+		store  *Store
+		secret Secret
+	}{
+		{name: "wrong key", store: newTestStore(t), secret: secret},
+		{name: "no key", store: &Store{}, secret: secret},
+		{name: "modified value", store: s, secret: Secret{Name: "TOKEN", Value: string(tampered)}},
+		{name: "invalid base64", store: s, secret: Secret{Name: "TOKEN", Value: "not base64!"}},
+		{name: "too short", store: s, secret: Secret{Name: "TOKEN", Value: "AAAA"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := tt.store.Decrypt(tt.secret)
+			if err == nil {
+				t.Errorf("Decrypt succeeded with %q, expected an error", value)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []string{
+		"",
+		"not base64!",
+		"c2hvcnQ=", // "short"
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", // 54 bytes
+	}
+
+	for _, key := range tests {
+		_, err := ParseKey(key)
+		if err == nil {
+			t.Errorf("ParseKey(%q) succeeded, expected an error", key)
+		}
+	}
+}
+
+func TestAvailableTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  Secret
+		context string
+		fork    bool
+		want    bool
+	}{
+		{name: "all contexts", secret: Secret{}, context: "build", want: true},
+		{name: "all contexts, default context", secret: Secret{}, context: "", want: true},
+		{name: "listed context", secret: Secret{Contexts: []string{"build", "deploy"}}, context: "deploy", want: true},
+		{name: "other context", secret: Secret{Contexts: []string{"deploy"}}, context: "build", want: false},
+		{name: "default context not listed", secret: Secret{Contexts: []string{"deploy"}}, context: "", want: false},
+		{name: "fork", secret: Secret{}, context: "build", fork: true, want: false},
+		{name: "fork allowed", secret: Secret{AllowForks: true}, context: "build", fork: true, want: true},
+		{name: "fork allowed, other context", secret: Secret{AllowForks: true, Contexts: []string{"deploy"}}, context: "build", fork: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.secret.AvailableTo(tt.context, tt.fork)
+			if got != tt.want {
+				t.Errorf("AvailableTo(%q, %v) = %v, expected %v", tt.context, tt.fork, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+'use strict';
+
+// Keep the list of active jobs up to date by listening to server-sent events
+let jobs = [];
+const table = document.querySelector("#active-jobs tbody");
+
+function formatElapsed(job) {
+    let since = new Date(job.started);
+    if (since.getFullYear() <= 1) {
+        since = new Date(job.created);
+    }
+
+    let seconds = Math.max(0, Math.floor((Date.now() - since.getTime()) / 1000));
+    let parts = [];
+    if (seconds >= 3600) {
+        parts.push(Math.floor(seconds / 3600) + "h");
+        seconds %= 3600;
+    }
+    if (seconds >= 60 || parts.length > 0) {
+        parts.push(Math.floor(seconds / 60) + "m");
+        seconds %= 60;
+    }
+    parts.push(seconds + "s");
+    return parts.join("");
+}
+
+function cell(row, contents) {
+    let td = document.createElement("td");
+    if (contents instanceof Node) {
+        td.appendChild(contents);
+    } else {
+        td.textContent = contents;
+    }
+    row.appendChild(td);
+    return td;
+}
+
+function link(href, text) {
+    let a = document.createElement("a");
+    a.href = href;
+    a.textContent = text;
+    return a;
+}
+
+function status(job) {
+    let span = document.createElement("span");
+    if (job.status === 1) {
+        span.className = "executing";
+        span.textContent = "Executing";
+    } else {
+        span.className = "pending";
+        span.textContent = "Pending";
+    }
+    return span;
+}
+
+function render() {
+    table.textContent = "";
+    for (let job of jobs) {
+        let row = document.createElement("tr");
+        cell(row, link("/job/" + job.id, job.id));
+        cell(row, job.repository);
+        cell(row, job.queue);
+        cell(row, job.context);
+        cell(row, job.script);
+        cell(row, status(job));
+        cell(row, formatElapsed(job)).className = "elapsed";
+
+        let cancel = link("/job/" + job.id + "/cancel", "cancel");
+        cancel.addEventListener("click", function (ev) {
+            ev.preventDefault();
+            // Don't follow the redirect to the job page, the event stream will tell us when the job is gone
+            fetch(this.href, {redirect: "manual"});
+        });
+        cell(row, cancel);
+        table.appendChild(row);
+    }
+}
+
+const events = new EventSource("/jobs/active/events");
+events.onmessage = function (ev) {
+    jobs = JSON.parse(ev.data) || [];
+    render();
+};
+
+window.setInterval(function () {
+    let cells = table.querySelectorAll(".elapsed");
+    for (let i = 0; i < cells.length && i < jobs.length; i++) {
+        cells[i].textContent = formatElapsed(jobs[i]);
+    }
+}, 1000);
@@ -15,4 +15,5 @@ func usage() {
 	fmt.Println(" - MICROCI_ADDRESS          address to bind webhook listener to (defaults to all available addresses)")
 	fmt.Println(" - MICROCI_GITEA_USERNAME   username used when connecting to gitea")
 	fmt.Println(" - MICROCI_GITEA_PASSWORD   password used when connecting to gitea")
+	fmt.Println(" - MICROCI_SECRETS_KEY      key used to encrypt secrets, see 'microci secret generate-key'")
 }
@@ -2,15 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -21,7 +24,7 @@ import (
 	"github.com/yzzyx/microci/job"
 )
 
-var errNotFound = errors.New("not found")
+var errNotFound = job.ErrNotFound
 
 // View is the base structure for views
 type View struct {
@@ -74,10 +77,90 @@ func (v *View) CancelJob(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// GetArtifact returns a specific artifact from a job
+// RerunJob creates a new job from an existing one, and redirects to it
+func (v *View) RerunJob(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "id")
+
+	prev, err := v.manager.GetJob(id)
+	if err != nil {
+		return err
+	}
+
+	j, err := v.manager.RerunJob(prev)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/job/"+j.ID, http.StatusFound)
+	return nil
+}
+
+// triggerVars contains the variables used by the trigger form
+type triggerVars struct {
+	Title        string
+	Refresh      bool
+	Repositories []string
+	Error        string
+
+	Repository string
+	Ref        string
+	Commit     string
+	Script     string
+	Context    string
+}
+
+// GetTrigger shows a form used to manually trigger a job
+func (v *View) GetTrigger(w http.ResponseWriter, r *http.Request) error {
+	vars := triggerVars{
+		Title:        "trigger job",
+		Repositories: v.manager.ScriptRepos(),
+		Repository:   r.URL.Query().Get("repository"),
+		Ref:          r.URL.Query().Get("ref"),
+		Script:       r.URL.Query().Get("script"),
+		Context:      r.URL.Query().Get("context"),
+	}
+	return v.templates.ExecuteTemplate(w, "trigger.html", vars)
+}
+
+// PostTrigger creates a job from the trigger form, and redirects to it
+func (v *View) PostTrigger(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+
+	vars := triggerVars{
+		Title:        "trigger job",
+		Repositories: v.manager.ScriptRepos(),
+		Repository:   r.PostForm.Get("repository"),
+		Ref:          r.PostForm.Get("ref"),
+		Commit:       r.PostForm.Get("commit"),
+		Script:       r.PostForm.Get("script"),
+		Context:      r.PostForm.Get("context"),
+	}
+
+	j, err := v.manager.TriggerJob(TriggerOptions{
+		Repository: vars.Repository,
+		Ref:        vars.Ref,
+		Commit:     vars.Commit,
+		Script:     vars.Script,
+		Context:    vars.Context,
+	})
+	if err != nil {
+		// Show the form again, so that the user can correct the input
+		vars.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		return v.templates.ExecuteTemplate(w, "trigger.html", vars)
+	}
+
+	http.Redirect(w, r, "/job/"+j.ID, http.StatusFound)
+	return nil
+}
+
+// GetArtifact returns a specific artifact from a job, or lists the contents of a folder of artifacts
 func (v *View) GetArtifact(w http.ResponseWriter, r *http.Request) error {
 	id := chi.URLParam(r, "id")
-	name := chi.URLParam(r, "name")
+	name := chi.URLParam(r, "*")
 
 	job, err := v.manager.GetJob(id)
 	if err != nil {
@@ -86,37 +169,249 @@ func (v *View) GetArtifact(w http.ResponseWriter, r *http.Request) error {
 
 	name, err = url.PathUnescape(name)
 	if err != nil {
-		return err
+		return errNotFound
 	}
 
-	f, err := os.Open(filepath.Join(job.Folder, "artifacts", name))
+	name = path.Clean("/" + name)
+	p, st, err := artifactPath(job, name)
 	if err != nil {
 		return err
 	}
 
-	mimetype := mime.TypeByExtension(name)
-	if mimetype != "" {
-		w.Header().Add("Content-type", mimetype)
+	if st.IsDir() {
+		return v.listArtifacts(w, job, name, p)
 	}
 
-	_, err = io.Copy(w, f)
+	f, err := os.Open(p)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	contentType, err := artifactContentType(name, f)
+	if err != nil {
+		return err
+	}
+
+	// Artifacts are created by scripts, which may run code from pull requests. The sandbox policy
+	// keeps HTML artifacts from running scripts or accessing microci, while still allowing them to be viewed
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !isViewable(contentType) {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	}
+
+	http.ServeContent(w, r, path.Base(name), st.ModTime(), f)
 	return nil
 }
 
+// artifactEntry describes a file or folder in a listing of artifacts
+type artifactEntry struct {
+	Name  string
+	Path  string // Escaped path relative to the artifact folder
+	IsDir bool
+	Size  string
+}
+
+// listArtifacts lists the files and folders in folder p, which is the folder name within the artifacts of j
+func (v *View) listArtifacts(w http.ResponseWriter, j *job.Job, name string, p string) error {
+	name = strings.Trim(filepath.ToSlash(name), "/")
+	vars := struct {
+		Title   string
+		Refresh bool
+		Job     *job.Job
+		Folder  string
+		Parent  string
+		Entries []artifactEntry
+	}{
+		Title:  fmt.Sprintf("j %s artifacts", j.ID),
+		Job:    j,
+		Folder: name,
+	}
+
+	if name != "" {
+		vars.Parent = job.EscapeArtifactPath(path.Dir(name))
+		if vars.Parent == "." {
+			vars.Parent = ""
+		}
+	}
+
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !f.IsDir() && !f.Mode().IsRegular() {
+			continue
+		}
+
+		entry := artifactEntry{
+			Name:  f.Name(),
+			Path:  job.EscapeArtifactPath(path.Join(name, f.Name())),
+			IsDir: f.IsDir(),
+		}
+		if !f.IsDir() {
+			entry.Size = job.Artifact{Size: f.Size()}.FormattedSize()
+		}
+		vars.Entries = append(vars.Entries, entry)
+	}
+	return v.templates.ExecuteTemplate(w, "artifacts.html", vars)
+}
+
+// GetProjects lists all repositories and the state of their queues
+func (v *View) GetProjects(w http.ResponseWriter, r *http.Request) error {
+	vars := struct {
+		Title        string
+		Refresh      bool
+		Repositories []*Repository
+	}{
+		Title:        "projects",
+		Repositories: v.manager.GetRepos(),
+	}
+
+	return v.templates.ExecuteTemplate(w, "projects.html", vars)
+}
+
+// GetVariables lists the environment variables available to scripts
+func (v *View) GetVariables(w http.ResponseWriter, r *http.Request) error {
+	vars := struct {
+		Title     string
+		Refresh   bool
+		Version   int
+		Variables []job.Variable
+		Legacy    []string
+	}{
+		Title:     "variables",
+		Version:   job.VariablesVersion,
+		Variables: job.Variables,
+		Legacy:    job.LegacyVariables(),
+	}
+
+	return v.templates.ExecuteTemplate(w, "variables.html", vars)
+}
+
+// GetProject shows all queues and jobs of a single repository
+func (v *View) GetProject(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "owner") + "/" + chi.URLParam(r, "name")
+
+	repo := v.manager.FindRepo(name)
+	if repo == nil {
+		return errNotFound
+	}
+
+	vars := struct {
+		Title      string
+		Refresh    bool
+		Repository *Repository
+	}{
+		Title:      name,
+		Repository: repo,
+	}
+
+	return v.templates.ExecuteTemplate(w, "project.html", vars)
+}
+
+// activeJob describes a job in the list of active jobs
+type activeJob struct {
+	ID         string        `json:"id"`
+	Repository string        `json:"repository"`
+	Queue      string        `json:"queue"`
+	Context    string        `json:"context"`
+	Script     string        `json:"script"`
+	Status     job.JobStatus `json:"status"`
+	Created    time.Time     `json:"created"`
+	Started    time.Time     `json:"started"`
+}
+
+// Elapsed returns the time the job has been executing, or waiting if it has not yet started
+func (a activeJob) Elapsed() time.Duration {
+	since := a.Started
+	if since.IsZero() {
+		since = a.Created
+	}
+	return time.Since(since).Truncate(time.Second)
+}
+
+func (v *View) activeJobs() []activeJob {
+	jobs := v.manager.GetActiveJobs()
+	list := make([]activeJob, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, activeJob{
+			ID:         j.ID,
+			Repository: j.CommitRepo,
+			Queue:      j.QueueName,
+			Context:    j.Context,
+			Script:     strings.TrimPrefix(strings.TrimPrefix(j.Script, v.cfg.Scripts.Folder), "/"),
+			Status:     j.Status,
+			Created:    j.Created,
+			Started:    j.Started,
+		})
+	}
+	return list
+}
+
+// GetActiveJobs lists all pending and executing jobs
+func (v *View) GetActiveJobs(w http.ResponseWriter, r *http.Request) error {
+	vars := struct {
+		Title   string
+		Refresh bool
+		Jobs    []activeJob
+	}{
+		Title: "active jobs",
+		Jobs:  v.activeJobs(),
+	}
+
+	return v.templates.ExecuteTemplate(w, "active.html", vars)
+}
+
+// GetActiveJobEvents streams the list of active jobs as server-sent events,
+// sending a new list every time it changes
+func (v *View) GetActiveJobEvents(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming not supported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var last []byte
+	for {
+		data, err := json.Marshal(v.activeJobs())
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(data, last) {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			last = data
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 // GetJob handles all requests to "/job/{id}"
 func (v *View) GetJob(w http.ResponseWriter, r *http.Request) error {
 	id := chi.URLParam(r, "id")
 
 	vars := struct {
 		Title     string
+		Refresh   bool
 		Job       *job.Job
 		URL       *url.URL
-		Artifacts []os.FileInfo
+		Artifacts []job.Artifact
+		CanRerun  bool // Re-running jobs from the web UI requires admin credentials
 	}{
-		URL: r.URL,
+		URL:      r.URL,
+		CanRerun: v.cfg.Server.Admin.Username != "",
 	}
 
 	j, err := v.manager.GetJob(id)
@@ -126,15 +421,9 @@ func (v *View) GetJob(w http.ResponseWriter, r *http.Request) error {
 
 	vars.Title = fmt.Sprintf("j %s", id)
 	vars.Job = j
+	vars.Refresh = !j.Status.IsFinished()
 
-	artifactFolder, err := os.Open(filepath.Join(j.Folder, "artifacts"))
-	if err == nil {
-		defer artifactFolder.Close()
-		vars.Artifacts, err = artifactFolder.Readdir(-1)
-		if err != nil {
-			return err
-		}
-	}
+	vars.Artifacts = j.ListArtifacts()
 
 	err = v.templates.ExecuteTemplate(w, "job.html", vars)
 	if err != nil {